@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
 
 	"leaderboard/internal/config"
+	"leaderboard/internal/domain/models"
 	"leaderboard/internal/repository"
 	"leaderboard/internal/server"
 	"leaderboard/internal/service"
@@ -14,6 +16,8 @@ import (
 )
 
 func main() {
+	resetDefaultBoard := flag.Bool("reset-default-board", false, "clear the default board's scores on startup")
+	flag.Parse()
 
 	cfg := config.New()
 
@@ -26,8 +30,20 @@ func main() {
 	// repo.ClearData(ctx)
 
 	leaderboardService := service.NewLeaderboardService(repo)
-	leaderboardService.RemoveLeaderboard(ctx)
-	handler := server.NewHandler(leaderboardService)
+	if err := leaderboardService.EnsureBoard(ctx, &models.Board{
+		Name:        cfg.DefaultBoard,
+		Description: "All players",
+		SortOrder:   models.SortDescending,
+		MaxEntries:  models.DefaultMaxEntries,
+	}); err != nil {
+		log.Fatal(err)
+	}
+	if *resetDefaultBoard {
+		if err := leaderboardService.RemoveLeaderboard(ctx, cfg.DefaultBoard); err != nil {
+			log.Fatal(err)
+		}
+	}
+	handler := server.NewHandler(leaderboardService, cfg.DefaultBoard)
 
 	router := mux.NewRouter()
 	handler.RegisterRoutes(router)
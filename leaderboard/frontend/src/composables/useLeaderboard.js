@@ -1,13 +1,13 @@
 import { ref, watch } from 'vue'
 import { useWebSocket } from './useWebSocket'
 
-export function useLeaderboard() {
+export function useLeaderboard(board = 'global') {
   const rankings = ref([])
   const recentlyUpdated = ref({})
-  const { isConnected, lastMessage, send } = useWebSocket('ws://localhost:9002/ws')
+  const { isConnected, lastMessage, send } = useWebSocket(`ws://localhost:9002/ws?board=${encodeURIComponent(board)}`)
 
   watch(lastMessage, (update) => {
-    if (!update) return
+    if (!update || update.board !== board) return
 
     console.log('update', update)
     if (update.type === 'full_update') {
@@ -34,7 +34,7 @@ export function useLeaderboard() {
     if (!isConnected.value) {
       throw new Error('Not connected to server')
     }
-    return send(scoreData)
+    return send({ ...scoreData, board })
   }
 
   return {
@@ -3,7 +3,11 @@ package config
 type Config struct {
     RedisAddr     string
     ServerAddress string
+    // LeaderboardKey prefixes the Redis keys of every board
     LeaderboardKey string
+    // DefaultBoard is served by /api/leaderboard and to WebSocket clients
+    // that do not ask for a board
+    DefaultBoard string
 }
 
 func New() *Config {
@@ -11,5 +15,6 @@ func New() *Config {
         RedisAddr:      "localhost:6379",
         ServerAddress:  ":9002",
         LeaderboardKey: "leaderboard",
+        DefaultBoard:   "global",
     }
 }
\ No newline at end of file
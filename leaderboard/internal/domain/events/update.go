@@ -7,16 +7,28 @@ import (
 
 type LeaderboardUpdate struct {
     Type      string           `json:"type"`
+    Board     string           `json:"board"`
     Player    *models.Player   `json:"player,omitempty"`
     Rankings  []*models.Player `json:"rankings,omitempty"`
+    Error     string           `json:"error,omitempty"`
     Timestamp int64           `json:"timestamp"`
 }
 
-func NewUpdate(updateType string, player *models.Player, rankings []*models.Player) LeaderboardUpdate {
+func NewUpdate(updateType, board string, player *models.Player, rankings []*models.Player) LeaderboardUpdate {
     return LeaderboardUpdate{
         Type:      updateType,
+        Board:     board,
         Player:    player,
         Rankings:  rankings,
         Timestamp: time.Now().Unix(),
     }
+}
+
+func NewError(board string, err error) LeaderboardUpdate {
+    return LeaderboardUpdate{
+        Type:      "error",
+        Board:     board,
+        Error:     err.Error(),
+        Timestamp: time.Now().Unix(),
+    }
 }
\ No newline at end of file
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// SortDescending ranks the highest score first, SortAscending the lowest
+	// (e.g. race times).
+	SortDescending = "desc"
+	SortAscending  = "asc"
+
+	DefaultMaxEntries = 100
+)
+
+var (
+	ErrBoardNotFound = errors.New("leaderboard not found")
+	ErrBoardExists   = errors.New("leaderboard already exists")
+	ErrInvalidBoard  = errors.New("invalid leaderboard")
+)
+
+// Board describes a named leaderboard, e.g. one per game mode or region.
+// Only the best MaxEntries scores are kept.
+type Board struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	SortOrder   string    `json:"sort_order"`
+	MaxEntries  int       `json:"max_entries"`
+	CreatedAt   time.Time `json:"created_at"`
+}
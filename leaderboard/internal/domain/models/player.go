@@ -1,6 +1,12 @@
 package models
 
-import "time"
+import (
+	"errors"
+	"time"
+)
+
+var ErrInvalidPlayer = errors.New("invalid player")
+
 type Player struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
@@ -6,12 +6,21 @@ import (
 )
 
 type LeaderboardRepository interface {
-	UpdateScore(ctx context.Context, player *models.Player) error
-	GetLeaderboard(ctx context.Context) ([]*models.Player, error)
-	RemoveLeaderboard(ctx context.Context, key string) error
+	CreateBoard(ctx context.Context, board *models.Board) error
+	GetBoard(ctx context.Context, name string) (*models.Board, error)
+	ListBoards(ctx context.Context) ([]*models.Board, error)
+	DeleteBoard(ctx context.Context, name string) error
+	UpdateScore(ctx context.Context, board *models.Board, player *models.Player) error
+	GetLeaderboard(ctx context.Context, board *models.Board) ([]*models.Player, error)
+	RemoveLeaderboard(ctx context.Context, name string) error
 }
 
 type LeaderboardService interface {
-	UpdatePlayerScore(ctx context.Context, player *models.Player) error
-	GetRankings(ctx context.Context) ([]*models.Player, error)
+	CreateBoard(ctx context.Context, board *models.Board) error
+	GetBoard(ctx context.Context, name string) (*models.Board, error)
+	ListBoards(ctx context.Context) ([]*models.Board, error)
+	DeleteBoard(ctx context.Context, name string) error
+	UpdatePlayerScore(ctx context.Context, board string, player *models.Player) error
+	GetRankings(ctx context.Context, board string) ([]*models.Player, error)
+	GetBoardRankings(ctx context.Context, board *models.Board) ([]*models.Player, error)
 }
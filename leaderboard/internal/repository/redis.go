@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"leaderboard/internal/config"
 	"leaderboard/internal/domain/models"
+	"sort"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -34,38 +35,159 @@ func NewRedisRepository(cfg *config.Config) (*RedisRepository, error) {
 	}, nil
 }
 
-func (r *RedisRepository) UpdateScore(ctx context.Context, player *models.Player) error {
-	pipe := r.client.Pipeline()
+// Each board keeps its scores in the sorted set <LeaderboardKey>:{<name>}:scores
+// and its metadata as JSON in <LeaderboardKey>:{<name>}:meta. The hash tag
+// keeps both in one Redis Cluster slot, so scripts and transactions can use
+// them together. Board names are listed in the set <LeaderboardKey>:boards.
+// Player details are shared by all boards.
 
-	// Update score in sorted set
-	// redis use &redis.Z
-	pipe.ZAdd(ctx, r.config.LeaderboardKey, &redis.Z{
-		Score:  player.Score,
-		Member: player.ID,
-	})
+func (r *RedisRepository) scoresKey(name string) string {
+	return fmt.Sprintf("%s:{%s}:scores", r.config.LeaderboardKey, name)
+}
+
+func (r *RedisRepository) metaKey(name string) string {
+	return fmt.Sprintf("%s:{%s}:meta", r.config.LeaderboardKey, name)
+}
+
+func (r *RedisRepository) boardsKey() string {
+	return r.config.LeaderboardKey + ":boards"
+}
+
+// createBoard stores a board's metadata unless it exists, and clears any
+// scores left under its name, e.g. by a write that raced with DeleteBoard.
+var createBoard = redis.NewScript(`
+if not redis.call("SET", KEYS[1], ARGV[1], "NX") then
+	return 0
+end
+redis.call("DEL", KEYS[2])
+return 1
+`)
+
+func (r *RedisRepository) CreateBoard(ctx context.Context, board *models.Board) error {
+	board.CreatedAt = time.Now()
+	boardData, err := json.Marshal(board)
+	if err != nil {
+		return fmt.Errorf("failed to marshal board: %w", err)
+	}
+
+	keys := []string{r.metaKey(board.Name), r.scoresKey(board.Name)}
+	created, err := createBoard.Run(ctx, r.client, keys, boardData).Int()
+	if err != nil {
+		return fmt.Errorf("failed to create board: %w", err)
+	}
+	if created == 0 {
+		return models.ErrBoardExists
+	}
+	return r.client.SAdd(ctx, r.boardsKey(), board.Name).Err()
+}
+
+func (r *RedisRepository) GetBoard(ctx context.Context, name string) (*models.Board, error) {
+	boardData, err := r.client.Get(ctx, r.metaKey(name)).Result()
+	if err == redis.Nil {
+		return nil, models.ErrBoardNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get board: %w", err)
+	}
+
+	var board models.Board
+	if err := json.Unmarshal([]byte(boardData), &board); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal board: %w", err)
+	}
+	return &board, nil
+}
+
+func (r *RedisRepository) ListBoards(ctx context.Context) ([]*models.Board, error) {
+	names, err := r.client.SMembers(ctx, r.boardsKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boards: %w", err)
+	}
+	sort.Strings(names)
+
+	boards := []*models.Board{}
+	for _, name := range names {
+		board, err := r.GetBoard(ctx, name)
+		if err == models.ErrBoardNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		boards = append(boards, board)
+	}
+	return boards, nil
+}
+
+func (r *RedisRepository) DeleteBoard(ctx context.Context, name string) error {
+	pipe := r.client.TxPipeline()
+	deleted := pipe.Del(ctx, r.metaKey(name))
+	pipe.Del(ctx, r.scoresKey(name))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete board: %w", err)
+	}
+	if err := r.client.SRem(ctx, r.boardsKey(), name).Err(); err != nil {
+		return fmt.Errorf("failed to delete board: %w", err)
+	}
+	if deleted.Val() == 0 {
+		return models.ErrBoardNotFound
+	}
+	return nil
+}
+
+// updateScore records a score on a board that still exists, so a write
+// racing with DeleteBoard cannot leave scores behind. ARGV[3] and ARGV[4]
+// are the rank range that fell out of the top MaxEntries.
+var updateScore = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[2], ARGV[1], ARGV[2])
+redis.call("ZREMRANGEBYRANK", KEYS[2], ARGV[3], ARGV[4])
+return 1
+`)
+
+func (r *RedisRepository) UpdateScore(ctx context.Context, board *models.Board, player *models.Player) error {
+	// Drop whoever fell out of the top MaxEntries
+	start, stop := 0, -board.MaxEntries-1
+	if board.SortOrder == models.SortAscending {
+		start, stop = board.MaxEntries, -1
+	}
 
-	// Store player details
 	player.UpdatedAt = time.Now()
 	playerData, err := json.Marshal(player)
 	if err != nil {
 		return fmt.Errorf("failed to marshal player: %w", err)
 	}
 
-	pipe.Set(ctx, fmt.Sprintf("player:%s", player.ID), playerData, 0)
+	keys := []string{r.metaKey(board.Name), r.scoresKey(board.Name)}
+	updated, err := updateScore.Run(ctx, r.client, keys, player.Score, player.ID, start, stop).Int()
+	if err != nil {
+		return fmt.Errorf("failed to update score: %w", err)
+	}
+	if updated == 0 {
+		return models.ErrBoardNotFound
+	}
 
-	_, err = pipe.Exec(ctx)
-	return err
+	// Store player details
+	return r.client.Set(ctx, fmt.Sprintf("player:%s", player.ID), playerData, 0).Err()
 }
 
-func (r *RedisRepository) GetLeaderboard(ctx context.Context) ([]*models.Player, error) {
-	results, err := r.client.ZRevRangeWithScores(ctx, r.config.LeaderboardKey, 0, 99).Result()
-	fmt.Printf("key: %v", r.config.LeaderboardKey)
+func (r *RedisRepository) GetLeaderboard(ctx context.Context, board *models.Board) ([]*models.Player, error) {
+	key := r.scoresKey(board.Name)
+	stop := int64(board.MaxEntries - 1)
 
+	var results []redis.Z
+	var err error
+	if board.SortOrder == models.SortAscending {
+		results, err = r.client.ZRangeWithScores(ctx, key, 0, stop).Result()
+	} else {
+		results, err = r.client.ZRevRangeWithScores(ctx, key, 0, stop).Result()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get leaderboard: %w", err)
 	}
 
-	var players []*models.Player
+	players := []*models.Player{}
 	for rank, z := range results {
 		playerID := z.Member.(string)
 		playerData, err := r.client.Get(ctx, fmt.Sprintf("player:%s", playerID)).Result()
@@ -81,7 +203,6 @@ func (r *RedisRepository) GetLeaderboard(ctx context.Context) ([]*models.Player,
 		player.Rank = rank + 1
 		player.Score = z.Score
 
-		fmt.Printf("player: %v", player)
 		players = append(players, &player)
 	}
 
@@ -96,7 +217,7 @@ func (r *RedisRepository) ClearData(ctx context.Context) error {
 	return nil
 }
 
-func (r *RedisRepository) RemoveLeaderboard(ctx context.Context, key string) error {
-
-	return r.client.Del(ctx, key).Err()
+// RemoveLeaderboard clears the scores of a board but keeps the board.
+func (r *RedisRepository) RemoveLeaderboard(ctx context.Context, name string) error {
+	return r.client.Del(ctx, r.scoresKey(name)).Err()
 }
@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"leaderboard/internal/config"
+	"leaderboard/internal/domain/models"
+)
+
+func newTestRepository(t *testing.T) (*RedisRepository, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return &RedisRepository{
+		client: redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+		config: &config.Config{LeaderboardKey: "leaderboard"},
+	}, mr
+}
+
+func rankedIDs(players []*models.Player) []string {
+	ids := []string{}
+	for _, player := range players {
+		ids = append(ids, player.ID)
+	}
+	return ids
+}
+
+// Only the best MaxEntries scores stay, best being lowest on ascending
+// boards.
+func TestUpdateScoreTrims(t *testing.T) {
+	tests := []struct {
+		sortOrder string
+		want      []string
+	}{
+		{models.SortDescending, []string{"carol", "bob"}},
+		{models.SortAscending, []string{"alice", "bob"}},
+	}
+	for _, tt := range tests {
+		repo, mr := newTestRepository(t)
+		ctx := context.Background()
+		board := &models.Board{Name: "race", SortOrder: tt.sortOrder, MaxEntries: 2}
+		if err := repo.CreateBoard(ctx, board); err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range []string{"alice", "bob", "carol"} {
+			if err := repo.UpdateScore(ctx, board, &models.Player{ID: id, Name: id, Score: float64(i + 1)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		players, err := repo.GetLeaderboard(ctx, board)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rankedIDs(players); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: rankings are %v, want %v", tt.sortOrder, got, tt.want)
+		}
+		if members, _ := mr.ZMembers(repo.scoresKey("race")); len(members) != 2 {
+			t.Errorf("%s: %d scores stored, want 2", tt.sortOrder, len(members))
+		}
+	}
+}
+
+// A score for a board deleted in the meantime is refused rather than left
+// behind, and a board created under the same name starts empty.
+func TestUpdateScoreOnDeletedBoard(t *testing.T) {
+	repo, mr := newTestRepository(t)
+	ctx := context.Background()
+	board := &models.Board{Name: "weekly", SortOrder: models.SortDescending, MaxEntries: 10}
+	if err := repo.CreateBoard(ctx, board); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteBoard(ctx, "weekly"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := repo.UpdateScore(ctx, board, &models.Player{ID: "alice", Score: 1})
+	if !errors.Is(err, models.ErrBoardNotFound) {
+		t.Errorf("UpdateScore on a deleted board returned %v, want ErrBoardNotFound", err)
+	}
+	if mr.Exists(repo.scoresKey("weekly")) {
+		t.Error("scores written for a deleted board")
+	}
+
+	// Scores left by an older writer are cleared when the board comes back
+	mr.ZAdd(repo.scoresKey("weekly"), 5, "mallory")
+	if err := repo.CreateBoard(ctx, board); err != nil {
+		t.Fatal(err)
+	}
+	if players, _ := repo.GetLeaderboard(ctx, board); len(players) != 0 {
+		t.Errorf("recreated board has rankings %v", rankedIDs(players))
+	}
+	if err := repo.CreateBoard(ctx, board); !errors.Is(err, models.ErrBoardExists) {
+		t.Errorf("creating the board twice returned %v, want ErrBoardExists", err)
+	}
+}
+
+// A board's keys share a hash tag, so they land in one Redis Cluster slot.
+func TestBoardKeysShareSlot(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	if meta, scores := repo.metaKey("eu-west"), repo.scoresKey("eu-west"); meta != "leaderboard:{eu-west}:meta" || scores != "leaderboard:{eu-west}:scores" {
+		t.Errorf("board keys are %q and %q", meta, scores)
+	}
+}
@@ -1,45 +1,154 @@
 package server
 
 import (
-    "encoding/json"
-    "net/http"
+	"encoding/json"
+	"errors"
+	"net/http"
 
 	"github.com/gorilla/mux"
+	"leaderboard/internal/domain/models"
 	"leaderboard/internal/ports"
 )
 
 type Handler struct {
-    service ports.LeaderboardService
-    hub     *WebSocketHub
+	service      ports.LeaderboardService
+	hub          *WebSocketHub
+	defaultBoard string
 }
 
-func NewHandler(service ports.LeaderboardService) *Handler {
-    hub := NewWebSocketHub(service)
-    go hub.Run()
-    
-    return &Handler{
-        service: service,
-        hub:     hub,
-    }
+func NewHandler(service ports.LeaderboardService, defaultBoard string) *Handler {
+	hub := NewWebSocketHub(service, defaultBoard)
+	go hub.Run()
+
+	return &Handler{
+		service:      service,
+		hub:          hub,
+		defaultBoard: defaultBoard,
+	}
 }
 
 func (h *Handler) RegisterRoutes(r *mux.Router) {
-    r.HandleFunc("/api/leaderboard", h.handleGetLeaderboard).Methods("GET")
-    r.HandleFunc("/ws", h.handleWebSocket)
-    r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static")))
+	r.HandleFunc("/api/leaderboard", h.handleGetLeaderboard).Methods("GET")
+	r.HandleFunc("/api/leaderboards", h.handleListBoards).Methods("GET")
+	r.HandleFunc("/api/leaderboards", h.handleCreateBoard).Methods("POST")
+	r.HandleFunc("/api/leaderboards/{name}", h.handleGetBoard).Methods("GET")
+	r.HandleFunc("/api/leaderboards/{name}", h.handleDeleteBoard).Methods("DELETE")
+	r.HandleFunc("/api/leaderboards/{name}/scores", h.handleSubmitScore).Methods("POST")
+	r.HandleFunc("/ws", h.handleWebSocket)
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static")))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
 
+// writeError maps service errors to status codes.
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrBoardNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, models.ErrBoardExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, models.ErrInvalidBoard), errors.Is(err, models.ErrInvalidPlayer):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleGetLeaderboard serves the rankings of the default board.
 func (h *Handler) handleGetLeaderboard(w http.ResponseWriter, r *http.Request) {
-    rankings, err := h.service.GetRankings(r.Context())
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
+	rankings, err := h.service.GetRankings(r.Context(), h.defaultBoard)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rankings)
+}
+
+func (h *Handler) handleListBoards(w http.ResponseWriter, r *http.Request) {
+	boards, err := h.service.ListBoards(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, boards)
+}
+
+func (h *Handler) handleCreateBoard(w http.ResponseWriter, r *http.Request) {
+	var board models.Board
+	if err := json.NewDecoder(r.Body).Decode(&board); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.CreateBoard(r.Context(), &board); err != nil {
+		writeError(w, err)
+		return
+	}
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(rankings)
+	writeJSON(w, http.StatusCreated, board)
+}
+
+// handleGetBoard serves a board's metadata along with its rankings.
+func (h *Handler) handleGetBoard(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	board, err := h.service.GetBoard(r.Context(), name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rankings, err := h.service.GetBoardRankings(r.Context(), board)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		*models.Board
+		Rankings []*models.Player `json:"rankings"`
+	}{board, rankings})
+}
+
+func (h *Handler) handleDeleteBoard(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == h.defaultBoard {
+		http.Error(w, "the default leaderboard cannot be deleted", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.DeleteBoard(r.Context(), name); err != nil {
+		writeError(w, err)
+		return
+	}
+	h.hub.boardDeleted(name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSubmitScore records a score on the board and pushes the new rankings
+// to the board's WebSocket subscribers.
+func (h *Handler) handleSubmitScore(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var player models.Player
+	if err := json.NewDecoder(r.Body).Decode(&player); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.UpdatePlayerScore(r.Context(), name, &player); err != nil {
+		writeError(w, err)
+		return
+	}
+	h.hub.broadcastUpdate(name, &player)
+
+	writeJSON(w, http.StatusOK, player)
 }
 
 func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-    h.hub.HandleConnection(w, r)
-}
\ No newline at end of file
+	h.hub.HandleConnection(w, r)
+}
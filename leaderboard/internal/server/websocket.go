@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -14,17 +13,32 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// clientMessage is what clients send over the WebSocket. A connection starts
+// subscribed to the board named in its ?board= query, or the default board,
+// and can follow more with {"type": "subscribe", "board": "..."} and
+// {"type": "unsubscribe", "board": "..."}. Anything else is a score
+// submission, {"id": ..., "name": ..., "score": ...}, for the board given or
+// the connection's own.
+type clientMessage struct {
+	Type  string `json:"type"`
+	Board string `json:"board"`
+	models.Player
+}
+
 type WebSocketHub struct {
-	service  ports.LeaderboardService
-	clients  map[*websocket.Conn]bool
+	service      ports.LeaderboardService
+	defaultBoard string
+	// clients maps each connection to the boards it is subscribed to
+	clients  map[*websocket.Conn]map[string]bool
 	mutex    sync.Mutex
 	upgrader websocket.Upgrader
 }
 
-func NewWebSocketHub(service ports.LeaderboardService) *WebSocketHub {
+func NewWebSocketHub(service ports.LeaderboardService, defaultBoard string) *WebSocketHub {
 	return &WebSocketHub{
-		service: service,
-		clients: make(map[*websocket.Conn]bool),
+		service:      service,
+		defaultBoard: defaultBoard,
+		clients:      make(map[*websocket.Conn]map[string]bool),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins for demo
@@ -38,6 +52,15 @@ func (h *WebSocketHub) Run() {
 }
 
 func (h *WebSocketHub) HandleConnection(w http.ResponseWriter, r *http.Request) {
+	board := r.URL.Query().Get("board")
+	if board == "" {
+		board = h.defaultBoard
+	}
+	if _, err := h.service.GetBoard(r.Context(), board); err != nil {
+		writeError(w, err)
+		return
+	}
+
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
@@ -46,34 +69,43 @@ func (h *WebSocketHub) HandleConnection(w http.ResponseWriter, r *http.Request)
 	defer conn.Close()
 
 	h.mutex.Lock()
-	h.clients[conn] = true
+	h.clients[conn] = make(map[string]bool)
 	h.mutex.Unlock()
 
 	// Send initial leaderboard data
-	rankings, err := h.service.GetRankings(r.Context())
-	if err == nil {
-		update := events.NewUpdate("full_update", nil, rankings)
-		conn.WriteJSON(update)
-	}
+	h.subscribe(r.Context(), conn, board)
 
 	// Handle incoming messages
 	for {
-		var player models.Player
-		err := conn.ReadJSON(&player)
-
-		fmt.Printf("submitted player: %v", player)
-
+		var msg clientMessage
+		err := conn.ReadJSON(&msg)
 		if err != nil {
 			log.Printf("Error reading message: %v", err)
 			break
 		}
 
-		if err := h.service.UpdatePlayerScore(r.Context(), &player); err != nil {
-			log.Printf("Error updating score: %v", err)
-			continue
+		target := msg.Board
+		if target == "" {
+			target = board
 		}
 
-		h.broadcastUpdate(&player)
+		switch msg.Type {
+		case "subscribe":
+			h.subscribe(r.Context(), conn, target)
+		case "unsubscribe":
+			h.mutex.Lock()
+			delete(h.clients[conn], target)
+			h.mutex.Unlock()
+		default:
+			player := msg.Player
+			if err := h.service.UpdatePlayerScore(r.Context(), target, &player); err != nil {
+				log.Printf("Error updating score: %v", err)
+				h.send(conn, events.NewError(target, err))
+				continue
+			}
+
+			h.broadcastUpdate(target, &player)
+		}
 	}
 
 	h.mutex.Lock()
@@ -81,19 +113,73 @@ func (h *WebSocketHub) HandleConnection(w http.ResponseWriter, r *http.Request)
 	h.mutex.Unlock()
 }
 
-func (h *WebSocketHub) broadcastUpdate(player *models.Player) {
-	rankings, err := h.service.GetRankings(context.Background())
+// subscribe adds the board to the connection's subscriptions and sends it
+// the current rankings.
+func (h *WebSocketHub) subscribe(ctx context.Context, conn *websocket.Conn, board string) {
+	rankings, err := h.service.GetRankings(ctx, board)
 	if err != nil {
-		log.Printf("Error getting rankings: %v", err)
+		h.send(conn, events.NewError(board, err))
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	subscriptions, ok := h.clients[conn]
+	if !ok {
 		return
 	}
+	subscriptions[board] = true
+	if err := conn.WriteJSON(events.NewUpdate("full_update", board, nil, rankings)); err != nil {
+		log.Printf("Error sending to client: %v", err)
+	}
+}
+
+// send writes to a single connection. Writes go through the hub's mutex so
+// they never interleave with a broadcast.
+func (h *WebSocketHub) send(conn *websocket.Conn, update events.LeaderboardUpdate) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := conn.WriteJSON(update); err != nil {
+		log.Printf("Error sending to client: %v", err)
+	}
+}
+
+// boardDeleted tells the board's subscribers that it is gone and drops it
+// from their subscriptions.
+func (h *WebSocketHub) boardDeleted(board string) {
+	update := events.NewError(board, models.ErrBoardNotFound)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for conn, subscriptions := range h.clients {
+		if !subscriptions[board] {
+			continue
+		}
+		delete(subscriptions, board)
+		if err := conn.WriteJSON(update); err != nil {
+			log.Printf("Error sending to client: %v", err)
+			conn.Close()
+			delete(h.clients, conn)
+		}
+	}
+}
 
-	update := events.NewUpdate("update", player, rankings)
+// broadcastUpdate sends the board's new rankings to every connection
+// subscribed to it.
+func (h *WebSocketHub) broadcastUpdate(board string, player *models.Player) {
+	rankings, err := h.service.GetRankings(context.Background(), board)
+	if err != nil {
+		log.Printf("Error getting rankings: %v", err)
+		return
+	}
 
-	fmt.Printf("update: %v", update)
+	update := events.NewUpdate("update", board, player, rankings)
 
 	h.mutex.Lock()
-	for conn := range h.clients {
+	for conn, subscriptions := range h.clients {
+		if !subscriptions[board] {
+			continue
+		}
 		if err := conn.WriteJSON(update); err != nil {
 			log.Printf("Error sending to client: %v", err)
 			conn.Close()
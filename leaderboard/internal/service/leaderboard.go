@@ -2,11 +2,19 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"regexp"
 
 	"leaderboard/internal/domain/models"
 	"leaderboard/internal/ports"
 )
 
+const maxEntriesLimit = 1000
+
+// Board names go into Redis keys and URLs, so keep them simple
+var validBoardName = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
 type LeaderboardService struct {
 	repo ports.LeaderboardRepository
 }
@@ -17,14 +25,73 @@ func NewLeaderboardService(repo ports.LeaderboardRepository) *LeaderboardService
 	}
 }
 
-func (s *LeaderboardService) UpdatePlayerScore(ctx context.Context, player *models.Player) error {
-	return s.repo.UpdateScore(ctx, player)
+// CreateBoard validates the board, fills in the default sort order and
+// size, and stores it.
+func (s *LeaderboardService) CreateBoard(ctx context.Context, board *models.Board) error {
+	if !validBoardName.MatchString(board.Name) {
+		return fmt.Errorf("%w: name must be 1-64 lowercase letters, digits, - or _", models.ErrInvalidBoard)
+	}
+	switch board.SortOrder {
+	case "":
+		board.SortOrder = models.SortDescending
+	case models.SortDescending, models.SortAscending:
+	default:
+		return fmt.Errorf("%w: sort_order must be %q or %q", models.ErrInvalidBoard, models.SortDescending, models.SortAscending)
+	}
+	if board.MaxEntries == 0 {
+		board.MaxEntries = models.DefaultMaxEntries
+	}
+	if board.MaxEntries < 0 || board.MaxEntries > maxEntriesLimit {
+		return fmt.Errorf("%w: max_entries must be between 1 and %d", models.ErrInvalidBoard, maxEntriesLimit)
+	}
+	return s.repo.CreateBoard(ctx, board)
+}
+
+// EnsureBoard creates the board unless it already exists.
+func (s *LeaderboardService) EnsureBoard(ctx context.Context, board *models.Board) error {
+	if err := s.CreateBoard(ctx, board); err != nil && !errors.Is(err, models.ErrBoardExists) {
+		return err
+	}
+	return nil
+}
+
+func (s *LeaderboardService) GetBoard(ctx context.Context, name string) (*models.Board, error) {
+	return s.repo.GetBoard(ctx, name)
+}
+
+func (s *LeaderboardService) ListBoards(ctx context.Context) ([]*models.Board, error) {
+	return s.repo.ListBoards(ctx)
+}
+
+func (s *LeaderboardService) DeleteBoard(ctx context.Context, name string) error {
+	return s.repo.DeleteBoard(ctx, name)
+}
+
+func (s *LeaderboardService) UpdatePlayerScore(ctx context.Context, board string, player *models.Player) error {
+	if player.ID == "" {
+		return fmt.Errorf("%w: id is required", models.ErrInvalidPlayer)
+	}
+	b, err := s.repo.GetBoard(ctx, board)
+	if err != nil {
+		return err
+	}
+	return s.repo.UpdateScore(ctx, b, player)
+}
+
+func (s *LeaderboardService) GetRankings(ctx context.Context, board string) ([]*models.Player, error) {
+	b, err := s.repo.GetBoard(ctx, board)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetBoardRankings(ctx, b)
 }
 
-func (s *LeaderboardService) GetRankings(ctx context.Context) ([]*models.Player, error) {
-	return s.repo.GetLeaderboard(ctx)
+// GetBoardRankings returns the rankings of a board the caller has already
+// fetched.
+func (s *LeaderboardService) GetBoardRankings(ctx context.Context, board *models.Board) ([]*models.Player, error) {
+	return s.repo.GetLeaderboard(ctx, board)
 }
 
-func (s *LeaderboardService) RemoveLeaderboard(ctx context.Context) error {
-	return s.repo.RemoveLeaderboard(ctx, "leaderboard")
+func (s *LeaderboardService) RemoveLeaderboard(ctx context.Context, board string) error {
+	return s.repo.RemoveLeaderboard(ctx, board)
 }
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"leaderboard/internal/config"
+	"leaderboard/internal/domain/models"
+	"leaderboard/internal/repository"
+)
+
+func newTestService(t *testing.T) *LeaderboardService {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	cfg := config.New()
+	cfg.RedisAddr = mr.Addr()
+	repo, err := repository.NewRedisRepository(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLeaderboardService(repo)
+}
+
+func TestCreateBoard(t *testing.T) {
+	svc := newTestService(t)
+	tests := []struct {
+		name           string
+		board          models.Board
+		wantErr        error
+		wantSortOrder  string
+		wantMaxEntries int
+	}{
+		{"defaults", models.Board{Name: "weekly"}, nil, models.SortDescending, models.DefaultMaxEntries},
+		{"ascending", models.Board{Name: "speedrun_1", SortOrder: models.SortAscending, MaxEntries: 5}, nil, models.SortAscending, 5},
+		{"largest", models.Board{Name: "all-time", MaxEntries: maxEntriesLimit}, nil, models.SortDescending, maxEntriesLimit},
+		{"exists", models.Board{Name: "weekly"}, models.ErrBoardExists, "", 0},
+		{"empty name", models.Board{}, models.ErrInvalidBoard, "", 0},
+		{"uppercase name", models.Board{Name: "Weekly"}, models.ErrInvalidBoard, "", 0},
+		{"name with a colon", models.Board{Name: "a:b"}, models.ErrInvalidBoard, "", 0},
+		{"name too long", models.Board{Name: strings.Repeat("a", 65)}, models.ErrInvalidBoard, "", 0},
+		{"unknown sort order", models.Board{Name: "odd", SortOrder: "random"}, models.ErrInvalidBoard, "", 0},
+		{"negative size", models.Board{Name: "neg", MaxEntries: -1}, models.ErrInvalidBoard, "", 0},
+		{"too large", models.Board{Name: "huge", MaxEntries: maxEntriesLimit + 1}, models.ErrInvalidBoard, "", 0},
+	}
+	for _, tt := range tests {
+		board := tt.board
+		err := svc.CreateBoard(context.Background(), &board)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: returned %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		stored, err := svc.GetBoard(context.Background(), board.Name)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if stored.SortOrder != tt.wantSortOrder || stored.MaxEntries != tt.wantMaxEntries {
+			t.Errorf("%s: stored %s with %d entries, want %s with %d", tt.name, stored.SortOrder, stored.MaxEntries, tt.wantSortOrder, tt.wantMaxEntries)
+		}
+	}
+
+	if err := svc.EnsureBoard(context.Background(), &models.Board{Name: "weekly"}); err != nil {
+		t.Errorf("EnsureBoard on an existing board returned %v", err)
+	}
+}
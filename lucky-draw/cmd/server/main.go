@@ -9,6 +9,7 @@ import (
 	"luckydraw/internal/handlers"
 	"luckydraw/internal/store"
 	"luckydraw/internal/websocket"
+	"session-management/authclient"
 )
 
 func main() {
@@ -23,15 +24,16 @@ func main() {
 	go hub.Run()
 	
 	handler := handlers.NewHandler(store, hub)
-	router := setupRoutes(handler)
+	authClient := authclient.New(cfg.AuthURL)
+	router := setupRoutes(handler, authClient)
 	
 	log.Printf("Server starting on %s", cfg.ServerAddr)
 	log.Fatal(http.ListenAndServe(cfg.ServerAddr, router))
 }
 
-func setupRoutes(h *handlers.Handler) *mux.Router {
+func setupRoutes(h *handlers.Handler, authClient *authclient.Client) *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/api/draw/start", h.StartDraw).Methods("POST")
+	router.HandleFunc("/api/draw/start", authClient.RequirePermission("luckydraw:admin", h.StartDraw)).Methods("POST")
 	router.HandleFunc("/api/draw/claim", h.ClaimPrize).Methods("POST")
 	router.HandleFunc("/ws", h.HandleWebSocket)
 	
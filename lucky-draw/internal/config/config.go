@@ -3,11 +3,13 @@ package config
 type Config struct {
 	RedisAddr  string
 	ServerAddr string
+	AuthURL    string
 }
 
 func New() *Config {
 	return &Config{
 		RedisAddr:  "localhost:6379",
 		ServerAddr: ":9004",
+		AuthURL:    "http://localhost:9001",
 	}
 }
\ No newline at end of file
@@ -8,14 +8,18 @@ import (
 	"syscall"
 
 	"sales-analytics/internal/api"
+	"sales-analytics/internal/config"
 	"sales-analytics/internal/storage"
+	"session-management/authclient"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	cfg := config.New()
+
 	// Initialize Redis store
-	redisStore := storage.NewRedisStore("localhost:6379")
+	redisStore := storage.NewRedisStore(cfg.RedisAddr)
 	defer redisStore.Close()
 
 	// Initialize analytics store
@@ -23,16 +27,17 @@ func main() {
 
 	// Initialize server
 	server := api.NewServer(analyticsStore)
+	authClient := authclient.New(cfg.AuthURL)
 	router := mux.NewRouter()
 
 	// Register routes
 	router.HandleFunc("/ws", server.HandleWebSocket)
 	router.HandleFunc("/api/sales", server.HandleSale).Methods("POST")
 	router.HandleFunc("/api/sale-random", server.HandleSaleRandom).Methods("POST")
-	router.HandleFunc("/api/remove-all", server.RemoveAll).Methods("POST")
+	router.HandleFunc("/api/remove-all", authClient.RequirePermission("analytics:admin", server.RemoveAll)).Methods("POST")
 	// Create server with router
 	httpServer := &http.Server{
-		Addr:    ":9003",
+		Addr:    cfg.ServerAddr,
 		Handler: router,
 	}
 
@@ -49,7 +54,7 @@ func main() {
 	}()
 
 	// Start server
-	log.Println("Server starting on :9003")
+	log.Printf("Server starting on %s", cfg.ServerAddr)
 	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
@@ -0,0 +1,15 @@
+package config
+
+type Config struct {
+	RedisAddr  string
+	ServerAddr string
+	AuthURL    string
+}
+
+func New() *Config {
+	return &Config{
+		RedisAddr:  "localhost:6379",
+		ServerAddr: ":9003",
+		AuthURL:    "http://localhost:9001",
+	}
+}
@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminTokenHeader = "X-Admin-Token"
+
+// requireAdmin lets a request through if it carries the configured admin
+// token in X-Admin-Token, or a session with AdminPermission, and writes an
+// error response otherwise. The admin token is how the first admin role gets
+// assigned; while it is unset, only sessions can authorize.
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if token := r.Header.Get(adminTokenHeader); token != "" {
+		if s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1 {
+			return true
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	_, session, err := s.authenticatedSession(r)
+	if errors.Is(err, ErrStepUpRequired) {
+		writeStepUpRequired(w)
+		return false
+	}
+	if errors.Is(err, ErrSessionNotFound) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	if csrfRequired(r) && !validCSRF(r, session.CSRFToken) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return false
+	}
+	if session.ImpersonatorID != "" {
+		http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+		return false
+	}
+	if !HasPermission(session.Permissions, AdminPermission) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// clientIP returns the address the request came from. X-Forwarded-For is
+// only honoured when the server is configured to sit behind a proxy, or
+// when the request comes from one of the trusted proxies, such as
+// frontend/server.js or a service using authclient. Those set the header to
+// the address they saw, so the last entry is theirs.
+func (s *Server) clientIP(r *http.Request) string {
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded != "" && s.config.TrustProxyHeaders {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if forwarded != "" && s.fromTrustedProxy(r) {
+		entries := strings.Split(forwarded, ",")
+		return strings.TrimSpace(entries[len(entries)-1])
+	}
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fromTrustedProxy reports whether the request's peer is one of
+// Config.TrustedProxies.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	ip := net.ParseIP(remoteIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies accepts CIDR ranges and bare addresses.
+func parseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// handleAdminListSessions lists live sessions across all users. The user_id
+// and ip query parameters filter on exact matches; min_age and max_age take
+// Go durations such as "30m" and filter on time since creation.
+func (s *Server) handleAdminListSessions(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	var minAge, maxAge time.Duration
+	var err error
+	if value := query.Get("min_age"); value != "" {
+		if minAge, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "Invalid min_age", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("max_age"); value != "" {
+		if maxAge, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "Invalid max_age", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultEventLimit
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 {
+		limit = value
+	}
+
+	now := time.Now()
+	sessions := make([]SessionInfo, 0)
+	err = s.sessions.Scan(r.Context(), func(token string, session *Session) bool {
+		age := now.Sub(session.CreatedAt)
+		switch {
+		case query.Get("user_id") != "" && session.UserID != query.Get("user_id"):
+		case query.Get("ip") != "" && session.IP != query.Get("ip"):
+		case minAge > 0 && age < minAge:
+		case maxAge > 0 && age > maxAge:
+		default:
+			info := newSessionInfo(token, session)
+			info.UserID = session.UserID
+			info.Email = session.Email
+			sessions = append(sessions, info)
+		}
+		return len(sessions) < limit
+	})
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+// handleAdminExpireSession force-expires the session with the given public
+// ID, together with its refresh tokens.
+func (s *Server) handleAdminExpireSession(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var expireReq struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&expireReq); err != nil || expireReq.ID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var target string
+	var targetSession *Session
+	err := s.sessions.Scan(r.Context(), func(token string, session *Session) bool {
+		if sessionID(token) == expireReq.ID {
+			target = token
+			targetSession = session
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if target == "" {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.revokeSession(r.Context(), target); err != nil && !errors.Is(err, ErrSessionNotFound) {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	eventType := AuditSessionRevoked
+	if targetSession.ImpersonatorID != "" {
+		eventType = AuditImpersonationEnded
+	}
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    eventType,
+		UserID:  targetSession.UserID,
+		Actor:   s.adminActor(r),
+		Outcome: AuditSuccess,
+		Detail:  expireReq.ID,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Session expired",
+	})
+}
+
+// sessionReencrypter is implemented by session stores that encrypt.
+type sessionReencrypter interface {
+	Reencrypt(ctx context.Context) (int, error)
+}
+
+// handleAdminReencryptSessions starts re-encrypting all sessions under the
+// primary session key in the background. Run it after rotating the keys;
+// once it has finished, the old key can be removed.
+func (s *Server) handleAdminReencryptSessions(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	reencrypter, ok := s.sessions.(sessionReencrypter)
+	if !ok || len(s.config.SessionKeys) == 0 {
+		http.Error(w, "Session encryption is not configured", http.StatusBadRequest)
+		return
+	}
+	if !s.reencrypting.CompareAndSwap(false, true) {
+		http.Error(w, "Re-encryption already running", http.StatusConflict)
+		return
+	}
+
+	go func() {
+		defer s.reencrypting.Store(false)
+		rewritten, err := reencrypter.Reencrypt(context.Background())
+		if err != nil {
+			log.Printf("Session re-encryption failed after %d sessions: %v", rewritten, err)
+			return
+		}
+		log.Printf("Re-encrypted %d sessions", rewritten)
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Re-encryption started",
+	})
+}
+
+// sessionMigrator is implemented by session stores that may still hold
+// sessions in an older format.
+type sessionMigrator interface {
+	Migrate(ctx context.Context) (int, error)
+}
+
+// handleAdminMigrateSessions starts converting sessions stored as JSON
+// strings to hashes in the background. Sessions are converted when they are
+// used anyway, so this only speeds things up.
+func (s *Server) handleAdminMigrateSessions(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	migrator, ok := s.sessions.(sessionMigrator)
+	if !ok {
+		http.Error(w, "The session store needs no migration", http.StatusBadRequest)
+		return
+	}
+	if !s.migrating.CompareAndSwap(false, true) {
+		http.Error(w, "Migration already running", http.StatusConflict)
+		return
+	}
+
+	go func() {
+		defer s.migrating.Store(false)
+		migrated, err := migrator.Migrate(context.Background())
+		if err != nil {
+			log.Printf("Session migration failed after %d sessions: %v", migrated, err)
+			return
+		}
+		log.Printf("Migrated %d sessions", migrated)
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Migration started",
+	})
+}
+
+type AdminSessionsHandler struct {
+	server *Server
+}
+
+func NewAdminSessionsHandler(server *Server) *AdminSessionsHandler {
+	return &AdminSessionsHandler{server: server}
+}
+
+func (h *AdminSessionsHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	h.server.handleAdminListSessions(w, r)
+}
+
+func (h *AdminSessionsHandler) HandleExpire(w http.ResponseWriter, r *http.Request) {
+	h.server.handleAdminExpireSession(w, r)
+}
+
+func (h *AdminSessionsHandler) HandleReencrypt(w http.ResponseWriter, r *http.Request) {
+	h.server.handleAdminReencryptSessions(w, r)
+}
+
+func (h *AdminSessionsHandler) HandleMigrate(w http.ResponseWriter, r *http.Request) {
+	h.server.handleAdminMigrateSessions(w, r)
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	knownDevicesSuffix = ":known_devices"
+
+	// Values for Config.AnomalyPolicy
+	AnomalyPolicyOff    = "off"
+	AnomalyPolicyStepUp = "step_up"
+	AnomalyPolicyRevoke = "revoke"
+
+	// Values for Config.AnomalyRules
+	AnomalyRuleIPRange   = "ip_range"
+	AnomalyRuleUserAgent = "user_agent"
+)
+
+// ErrStepUpRequired is returned for sessions that were flagged as anomalous
+// and wait for the user to re-authenticate at /api/step-up.
+var ErrStepUpRequired = errors.New("re-authentication required")
+
+// The networks and devices a user has logged in from are kept in the set
+// user:<id>:known_devices, as "ip:<network>" and "ua:<device label>"
+// members. A session used from somewhere that is neither where it was
+// created nor known for the user is anomalous. Device labels rather than
+// full user agents are compared, so browser updates go unnoticed.
+
+func knownDevicesKey(userID string) string {
+	return userPrefix + userID + knownDevicesSuffix
+}
+
+// ipRange returns the network ip belongs to, with the configured prefix
+// lengths, e.g. 203.0.113.0/24.
+func (s *Server) ipRange(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	mask := net.CIDRMask(s.config.AnomalyIPv6Prefix, 8*net.IPv6len)
+	if v4 := parsed.To4(); v4 != nil {
+		parsed = v4
+		mask = net.CIDRMask(s.config.AnomalyIPv4Prefix, 8*net.IPv4len)
+	}
+	network := net.IPNet{IP: parsed.Mask(mask), Mask: mask}
+	return network.String()
+}
+
+// rememberDevice adds the network and device of a login to the user's known
+// devices.
+func (s *Server) rememberDevice(ctx context.Context, userID, ip, userAgent string) error {
+	key := knownDevicesKey(userID)
+	pipe := s.redis.Pipeline()
+	pipe.SAdd(ctx, key, "ip:"+s.ipRange(ip), "ua:"+deviceLabel(userAgent))
+	pipe.Expire(ctx, key, s.config.KnownDeviceTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// sessionAnomalies compares the request to where the session was created
+// and to the user's known devices, and describes whatever is new.
+func (s *Server) sessionAnomalies(ctx context.Context, r *http.Request, session *Session) ([]string, error) {
+	type candidate struct{ member, reason string }
+	var candidates []candidate
+	for _, rule := range s.config.AnomalyRules {
+		switch rule {
+		case AnomalyRuleIPRange:
+			current := s.ipRange(s.clientIP(r))
+			if current != s.ipRange(session.IP) {
+				candidates = append(candidates, candidate{"ip:" + current, "new IP range " + current})
+			}
+		case AnomalyRuleUserAgent:
+			current := deviceLabel(r.UserAgent())
+			if current != deviceLabel(session.UserAgent) {
+				candidates = append(candidates, candidate{"ua:" + current, "new device " + current})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	pipe := s.redis.Pipeline()
+	known := make([]*redis.BoolCmd, len(candidates))
+	for i, c := range candidates {
+		known[i] = pipe.SIsMember(ctx, knownDevicesKey(session.UserID), c.member)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var reasons []string
+	for i, c := range candidates {
+		if !known[i].Val() {
+			reasons = append(reasons, c.reason)
+		}
+	}
+	return reasons, nil
+}
+
+// checkSessionAnomalies applies the anomaly policy to a session that just
+// authenticated a request. It reports whether the request may go on; if not,
+// the response has been written. JWTs and API keys carry no creation
+// metadata to compare with, and impersonation sessions are expected to be
+// used from elsewhere, so none of them are checked. Neither is a call from a
+// trusted proxy that names no client: that is a service asking on its own
+// behalf, and its address says nothing about the user's.
+func (s *Server) checkSessionAnomalies(w http.ResponseWriter, r *http.Request, token string, session *Session) bool {
+	if s.config.AnomalyPolicy == AnomalyPolicyOff || isJWT(token) || session.APIKeyID != "" || session.ImpersonatorID != "" {
+		return true
+	}
+	if r.Header.Get("X-Forwarded-For") == "" && s.fromTrustedProxy(r) {
+		return true
+	}
+
+	reasons, err := s.sessionAnomalies(r.Context(), r, session)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	if len(reasons) == 0 {
+		return true
+	}
+	reason := strings.Join(reasons, ", ")
+
+	if s.config.AnomalyPolicy == AnomalyPolicyRevoke {
+		if err := s.revokeSession(r.Context(), token); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return false
+		}
+		s.audit(r.Context(), r, AuditEvent{
+			Type:    AuditSessionAnomaly,
+			UserID:  session.UserID,
+			Actor:   session.UserID,
+			Outcome: AuditFailure,
+			Detail:  reason + "; session revoked",
+		})
+		if err := s.sendAnomalyNotice(r.Context(), session, reason); err != nil {
+			log.Printf("Could not send anomaly notice: %v", err)
+		}
+		s.clearSessionCookies(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	session.StepUpRequired = true
+	session.AnomalyReason = reason
+	if err := s.sessions.Update(r.Context(), token, session); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditSessionAnomaly,
+		UserID:  session.UserID,
+		Actor:   session.UserID,
+		Outcome: AuditFailure,
+		Detail:  reason + "; re-authentication required",
+	})
+	writeStepUpRequired(w)
+	return false
+}
+
+func (s *Server) sendAnomalyNotice(ctx context.Context, session *Session, reason string) error {
+	return s.mailer.Send(ctx, Message{
+		To:      session.Email,
+		Subject: "We signed out a session of yours",
+		Body: fmt.Sprintf("Your session on %s was used from somewhere unusual (%s), so we signed it out.\r\n\r\n"+
+			"If that was you, just log in again. If not, reset your password at %s.",
+			session.DeviceLabel, reason, s.config.PublicURL),
+	})
+}
+
+func writeStepUpRequired(w http.ResponseWriter) {
+	writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+		"step_up_required": true,
+		"message":          "Re-authentication required",
+	})
+}
+
+// handleStepUp clears the anomaly flag of the caller's session once they
+// have entered their password again, and their TOTP code if they use one.
+// Failures count towards the login lockout.
+func (s *Server) handleStepUp(w http.ResponseWriter, r *http.Request) {
+	var stepUpReq struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&stepUpReq); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	token, _ := tokenFromRequest(r)
+	if isJWT(token) || isAPIKey(token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	session, err := s.sessions.Get(r.Context(), token)
+	if errors.Is(err, ErrSessionNotFound) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if csrfRequired(r) && !validCSRF(r, session.CSRFToken) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	if !session.StepUpRequired {
+		http.Error(w, "No re-authentication pending", http.StatusBadRequest)
+		return
+	}
+
+	ip := s.clientIP(r)
+	wait, err := s.loginRetryAfter(r.Context(), session.Email, ip)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	user, err := s.authenticate(r.Context(), session.Email, stepUpReq.Password)
+	if err == nil && user.TOTPEnabled {
+		err = s.verifyTOTP(r.Context(), user.ID, user.TOTPSecret, stepUpReq.Code)
+	}
+	if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrInvalidTwoFactorCode) {
+		s.audit(r.Context(), r, AuditEvent{
+			Type:    AuditLogin,
+			UserID:  session.UserID,
+			Actor:   session.UserID,
+			Outcome: AuditFailure,
+			Detail:  "step-up",
+		})
+		if err := s.recordLoginFailure(r.Context(), session.Email, ip); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.clearLoginFailures(r.Context(), session.Email)
+
+	session.StepUpRequired = false
+	session.AnomalyReason = ""
+	if err := s.sessions.Update(r.Context(), token, session); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.rememberDevice(r.Context(), session.UserID, ip, r.UserAgent()); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditLogin,
+		UserID:  session.UserID,
+		Actor:   session.UserID,
+		Outcome: AuditSuccess,
+		Detail:  "step-up",
+	})
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Re-authenticated",
+	})
+}
+
+type StepUpHandler struct {
+	server *Server
+}
+
+func NewStepUpHandler(server *Server) *StepUpHandler {
+	return &StepUpHandler{server: server}
+}
+
+func (h *StepUpHandler) HandleStepUp(w http.ResponseWriter, r *http.Request) {
+	h.server.handleStepUp(w, r)
+}
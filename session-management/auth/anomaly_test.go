@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// Services on loopback call check-auth for the browser and pass its address
+// on; the session is checked against that address, not the service's.
+func TestCheckAuthThroughTrustedProxy(t *testing.T) {
+	config := LoadConfig()
+	config.RedisAddr = miniredis.RunT(t).Addr()
+	config.MailDir = t.TempDir()
+	config.AnomalyPolicy = AnomalyPolicyStepUp
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := `{"email": "alice@example.com", "password": "correct horse"}`
+	rec := httptest.NewRecorder()
+	NewRegisterHandler(server).HandleRegister(rec, httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(credentials)))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(credentials))
+	req.RemoteAddr = "127.0.0.1:40000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	req.Header.Set("User-Agent", "test-browser")
+	rec = httptest.NewRecorder()
+	NewLoginHandler(server).HandleLogin(rec, req)
+	var loginResp struct {
+		SessionToken string `json:"session_token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&loginResp); err != nil || loginResp.SessionToken == "" {
+		t.Fatalf("login answered %d without a session token", rec.Code)
+	}
+
+	checkAuth := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/check-auth", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer "+loginResp.SessionToken)
+		req.Header.Set("User-Agent", "test-browser")
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		NewCheckAuthHandler(server).HandleCheckAuth(rec, req)
+		return rec.Code
+	}
+
+	if code := checkAuth("127.0.0.1:50000", "203.0.113.5"); code != http.StatusOK {
+		t.Errorf("check-auth for the same client answered %d", code)
+	}
+	if code := checkAuth("127.0.0.1:50000", ""); code != http.StatusOK {
+		t.Errorf("check-auth from a service without a client answered %d", code)
+	}
+	// An untrusted peer cannot claim the client's address
+	if code := checkAuth("198.51.100.7:50000", "203.0.113.5"); code != http.StatusUnauthorized {
+		t.Errorf("check-auth from another network answered %d, want 401", code)
+	}
+}
+
+// A session issued by refresh is checked against where the family's login
+// happened, so a refresh token used elsewhere does not vouch for its
+// network.
+func TestRefreshKeepsLoginOrigin(t *testing.T) {
+	tests := []struct {
+		name      string
+		refreshIP string
+		want      int
+	}{
+		{"same network", "203.0.113.9:40000", http.StatusOK},
+		{"new IP range", "198.51.100.7:40000", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		server, _ := newTestServer(t, func(config *Config) { config.AnomalyPolicy = AnomalyPolicyStepUp })
+		newTestUser(t, server, "alice@example.com")
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.5:40000"
+		login := logIn(t, server, req, "alice@example.com")
+
+		req = httptest.NewRequest(http.MethodPost, "/api/refresh", strings.NewReader(`{"refresh_token": "`+login.RefreshToken+`"}`))
+		req.RemoteAddr = tt.refreshIP
+		rec := httptest.NewRecorder()
+		NewRefreshHandler(server).HandleRefresh(rec, req)
+		var refreshed testLogin
+		if err := json.NewDecoder(rec.Body).Decode(&refreshed); err != nil || refreshed.SessionToken == "" {
+			t.Fatalf("%s: refresh answered %d without a session token", tt.name, rec.Code)
+		}
+
+		req = bearerRequest(http.MethodGet, "/api/check-auth", refreshed.SessionToken)
+		req.RemoteAddr = tt.refreshIP
+		rec = httptest.NewRecorder()
+		NewCheckAuthHandler(server).HandleCheckAuth(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: check-auth answered %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && !strings.Contains(rec.Body.String(), "step_up_required") {
+			t.Errorf("%s: check-auth did not ask for a step-up: %s", tt.name, rec.Body)
+		}
+	}
+}
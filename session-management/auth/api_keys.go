@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix  = "api_key:"
+	apiKeysKey    = "api_keys"
+	apiKeyMarker  = "ak~"
+	apiKeyIDSize  = 8
+	apiKeyTouchAt = time.Minute
+)
+
+// An API key reads ak~<id>_<secret>. The ~ is outside the base64url
+// alphabet of session tokens, so no session token can pass for an API key.
+// api_key:<id> is a hash with the key's metadata and the SHA-256 of the
+// whole key; the key itself is only shown once, when it is issued. api_keys
+// is the set of all key IDs.
+
+// APIKey is an API key's metadata. Scopes are permissions, just like the
+// ones roles grant to users.
+type APIKey struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyMarker)
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyID extracts the ID part of a key.
+func apiKeyID(key string) (string, bool) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(key, apiKeyMarker), "_")
+	return id, ok && len(id) == 2*apiKeyIDSize
+}
+
+func apiKeyFromHash(fields map[string]string) (*APIKey, error) {
+	apiKey := &APIKey{ID: fields["id"], Name: fields["name"]}
+	if err := json.Unmarshal([]byte(fields["scopes"]), &apiKey.Scopes); err != nil {
+		return nil, err
+	}
+	for _, field := range []struct {
+		name string
+		into *time.Time
+	}{
+		{"created_at", &apiKey.CreatedAt},
+		{"expires_at", &apiKey.ExpiresAt},
+		{"last_used_at", &apiKey.LastUsedAt},
+	} {
+		if fields[field.name] == "" {
+			continue
+		}
+		unix, err := strconv.ParseInt(fields[field.name], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		*field.into = time.Unix(unix, 0)
+	}
+	return apiKey, nil
+}
+
+func (s *Server) issueAPIKey(ctx context.Context, name string, scopes []string, ttl time.Duration) (string, *APIKey, error) {
+	id, err := randomHex(apiKeyIDSize)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := s.generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	key := apiKeyMarker + id + "_" + strings.TrimRight(secret, "=")
+
+	now := time.Now()
+	apiKey := &APIKey{
+		ID:        id,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, apiKeyPrefix+id,
+		"id", id,
+		"name", name,
+		"scopes", string(scopesJSON),
+		"hash", hashAPIKey(key),
+		"created_at", now.Unix(),
+		"expires_at", apiKey.ExpiresAt.Unix(),
+	)
+	pipe.ExpireAt(ctx, apiKeyPrefix+id, apiKey.ExpiresAt)
+	pipe.SAdd(ctx, apiKeysKey, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", nil, err
+	}
+	return key, apiKey, nil
+}
+
+// apiKeySession checks an API key and returns a session carrying its
+// scopes as permissions. Invalid, expired and revoked keys are reported as
+// ErrSessionNotFound, like unknown session tokens.
+func (s *Server) apiKeySession(ctx context.Context, key string) (*Session, error) {
+	id, ok := apiKeyID(key)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	fields, err := s.redis.HGetAll(ctx, apiKeyPrefix+id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 || subtle.ConstantTimeCompare([]byte(fields["hash"]), []byte(hashAPIKey(key))) != 1 {
+		return nil, ErrSessionNotFound
+	}
+	apiKey, err := apiKeyFromHash(fields)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !now.Before(apiKey.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+
+	// Only record use about once a minute, not on every request
+	if now.Sub(apiKey.LastUsedAt) >= apiKeyTouchAt {
+		s.redis.HSet(ctx, apiKeyPrefix+id, "last_used_at", now.Unix())
+		apiKey.LastUsedAt = now
+	}
+
+	return &Session{
+		CreatedAt:         apiKey.CreatedAt,
+		LastSeenAt:        apiKey.LastUsedAt,
+		ExpiresAt:         apiKey.ExpiresAt,
+		AbsoluteExpiresAt: apiKey.ExpiresAt,
+		APIKeyID:          apiKey.ID,
+		DeviceLabel:       apiKey.Name,
+		Roles:             []string{},
+		Permissions:       apiKey.Scopes,
+	}, nil
+}
+
+func (s *Server) handleIssueAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var issueReq struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn string   `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&issueReq); err != nil || issueReq.Name == "" || len(issueReq.Scopes) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	ttl := s.config.APIKeyTTL
+	if issueReq.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(issueReq.ExpiresIn); err != nil || ttl <= 0 {
+			http.Error(w, "Invalid expires_in", http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, apiKey, err := s.issueAPIKey(r.Context(), issueReq.Name, issueReq.Scopes, ttl)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":     key,
+		"api_key": apiKey,
+		"message": "Store the key now, it cannot be shown again",
+	})
+}
+
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	ids, err := s.redis.SMembers(r.Context(), apiKeysKey).Result()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	apiKeys := make([]*APIKey, 0, len(ids))
+	for _, id := range ids {
+		fields, err := s.redis.HGetAll(r.Context(), apiKeyPrefix+id).Result()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if len(fields) == 0 {
+			// Expired
+			s.redis.SRem(r.Context(), apiKeysKey, id)
+			continue
+		}
+		apiKey, err := apiKeyFromHash(fields)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	sort.Slice(apiKeys, func(i, j int) bool {
+		return apiKeys[i].CreatedAt.Before(apiKeys[j].CreatedAt)
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"api_keys": apiKeys,
+	})
+}
+
+func (s *Server) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var revokeReq struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&revokeReq); err != nil || revokeReq.ID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.redis.Del(r.Context(), apiKeyPrefix+revokeReq.ID).Result()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.redis.SRem(r.Context(), apiKeysKey, revokeReq.ID)
+	if deleted == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "API key revoked",
+	})
+}
+
+type APIKeysHandler struct {
+	server *Server
+}
+
+func NewAPIKeysHandler(server *Server) *APIKeysHandler {
+	return &APIKeysHandler{server: server}
+}
+
+func (h *APIKeysHandler) HandleIssue(w http.ResponseWriter, r *http.Request) {
+	h.server.handleIssueAPIKey(w, r)
+}
+
+func (h *APIKeysHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	h.server.handleListAPIKeys(w, r)
+}
+
+func (h *APIKeysHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	h.server.handleRevokeAPIKey(w, r)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// auditStreamKey is the Redis Stream every audit event is appended to. The
+// entry ID doubles as the event's timestamp and pagination cursor.
+const auditStreamKey = "audit_log"
+
+const (
+	AuditLogin           = "login"
+	AuditLogout          = "logout"
+	AuditSessionRevoked  = "session_revoked"
+	AuditPasswordChanged = "password_changed"
+
+	AuditImpersonationStarted = "impersonation_started"
+	AuditImpersonationEnded   = "impersonation_ended"
+	AuditSessionAnomaly       = "session_anomaly"
+
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+	// auditScanBatch is how many entries a query reads per XREVRANGE while
+	// looking for matches; auditScanBudget caps the entries one request may
+	// examine before it returns a cursor instead.
+	auditScanBatch  = 200
+	auditScanBudget = 5000
+)
+
+// AuditEvent records who did what from where, and whether it worked. Actor
+// is whoever acted: a user ID, an email for logins that failed before a
+// user was known, or "admin" for the admin token.
+type AuditEvent struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	UserID  string    `json:"user_id,omitempty"`
+	Actor   string    `json:"actor"`
+	IP      string    `json:"ip,omitempty"`
+	Outcome string    `json:"outcome"`
+	Detail  string    `json:"detail,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// audit appends an event to the audit stream and trims the stream to the
+// configured retention. Failing to write the trail does not fail the
+// request; it is logged instead.
+func (s *Server) audit(ctx context.Context, r *http.Request, event AuditEvent) {
+	if event.IP == "" && r != nil {
+		event.IP = s.clientIP(r)
+	}
+
+	pipe := s.redis.Pipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditStreamKey,
+		MaxLen: s.config.AuditMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"type":    event.Type,
+			"user_id": event.UserID,
+			"actor":   event.Actor,
+			"ip":      event.IP,
+			"outcome": event.Outcome,
+			"detail":  event.Detail,
+		},
+	})
+	if s.config.AuditRetention > 0 {
+		minID := strconv.FormatInt(time.Now().Add(-s.config.AuditRetention).UnixMilli(), 10)
+		pipe.XTrimMinIDApprox(ctx, auditStreamKey, minID, 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Could not write audit event %s (%s): %v", event.Type, event.Outcome, err)
+	}
+}
+
+func newAuditEvent(message redis.XMessage) AuditEvent {
+	field := func(name string) string {
+		value, _ := message.Values[name].(string)
+		return value
+	}
+	event := AuditEvent{
+		ID:      message.ID,
+		Type:    field("type"),
+		UserID:  field("user_id"),
+		Actor:   field("actor"),
+		IP:      field("ip"),
+		Outcome: field("outcome"),
+		Detail:  field("detail"),
+	}
+	if millis, err := strconv.ParseInt(strings.SplitN(message.ID, "-", 2)[0], 10, 64); err == nil {
+		event.At = time.UnixMilli(millis)
+	}
+	return event
+}
+
+// adminActor names whoever passed requireAdmin for the audit trail.
+func (s *Server) adminActor(r *http.Request) string {
+	if r.Header.Get(adminTokenHeader) != "" {
+		return "admin"
+	}
+	token, _ := tokenFromRequest(r)
+	if session, err := s.lookupSession(r.Context(), token); err == nil {
+		return session.UserID
+	}
+	return ""
+}
+
+// handleAuditEvents pages through the audit log, newest first. user_id and
+// type filter the events; pass the returned next_cursor as cursor to get
+// the next page. An empty next_cursor means the log has been exhausted.
+func (s *Server) handleAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultAuditLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+
+	// The cursor is the last ID the previous page looked at; "(" makes the
+	// range exclusive
+	end := "+"
+	if cursor := query.Get("cursor"); cursor != "" {
+		end = "(" + cursor
+	}
+
+	events := make([]AuditEvent, 0, limit)
+	nextCursor := ""
+	for examined := 0; len(events) < limit && examined < auditScanBudget; {
+		messages, err := s.redis.XRevRangeN(r.Context(), auditStreamKey, end, "-", auditScanBatch).Result()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if len(messages) == 0 {
+			nextCursor = ""
+			break
+		}
+
+		for _, message := range messages {
+			examined++
+			nextCursor = message.ID
+			event := newAuditEvent(message)
+			if (query.Get("user_id") == "" || event.UserID == query.Get("user_id")) &&
+				(query.Get("type") == "" || event.Type == query.Get("type")) {
+				events = append(events, event)
+				if len(events) == limit {
+					break
+				}
+			}
+		}
+		if len(messages) < auditScanBatch && len(events) < limit {
+			// Reached the oldest entry
+			nextCursor = ""
+			break
+		}
+		end = "(" + nextCursor
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"events":      events,
+		"next_cursor": nextCursor,
+	})
+}
+
+type AuditHandler struct {
+	server *Server
+}
+
+func NewAuditHandler(server *Server) *AuditHandler {
+	return &AuditHandler{server: server}
+}
+
+func (h *AuditHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	h.server.handleAuditEvents(w, r)
+}
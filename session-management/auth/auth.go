@@ -5,17 +5,32 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type Server struct {
-	redis *redis.Client
+	redis    redis.UniversalClient
+	sessions SessionStore
+	config   *Config
+	mailer   Mailer
+	oidc     *oidcProvider
+	keyring  *Keyring
+	jwtKeys  signingKeys
+	// trustedProxies are the parsed Config.TrustedProxies
+	trustedProxies []*net.IPNet
+	// magicLinkSecret signs magic link tokens
+	magicLinkSecret []byte
+
+	reencrypting atomic.Bool
+	migrating    atomic.Bool
 }
 
 type LoginRequest struct {
@@ -24,22 +39,145 @@ type LoginRequest struct {
 }
 
 type Session struct {
-	UserID    string    `json:"user_id"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	UserID     string    `json:"user_id"`
+	Email      string    `json:"email"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// ExpiresAt moves forward with every authenticated request, up to
+	// AbsoluteExpiresAt, after which the user has to log in again.
+	ExpiresAt         time.Time `json:"expires_at"`
+	AbsoluteExpiresAt time.Time `json:"absolute_expires_at"`
+	// RefreshFamily names the refresh token chain this session was issued
+	// with, so that ending the session also ends the chain.
+	RefreshFamily string `json:"refresh_family,omitempty"`
+	// Device metadata captured when the session was created
+	UserAgent   string `json:"user_agent,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	DeviceLabel string `json:"device_label,omitempty"`
+	// CSRFToken is set in cookie mode and must accompany state-changing
+	// requests that authenticate with the session cookie.
+	CSRFToken string `json:"csrf_token,omitempty"`
+	// Roles and the permissions they grant, loaded at login and updated
+	// when an admin changes them
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	// APIKeyID is set on the sessions that stand in for an API key. They
+	// belong to no user, and their permissions are the key's scopes.
+	APIKeyID string `json:"api_key_id,omitempty"`
+	// ImpersonatorID is set on impersonation sessions and names the admin
+	// acting as the user.
+	ImpersonatorID string `json:"impersonator_id,omitempty"`
+	// StepUpRequired is set when the session was used from an unknown
+	// network or device and the anomaly policy asks for re-authentication.
+	// AnomalyReason says what was unusual.
+	StepUpRequired bool   `json:"step_up_required,omitempty"`
+	AnomalyReason  string `json:"anomaly_reason,omitempty"`
 }
 
-func NewServer(redisAddr string) *Server {
-	rdb := redis.NewClient(&redis.Options{
-		Addr: redisAddr, // Redis server address
-	})
+// NewServer connects to Redis, or to Redis Cluster when
+// config.RedisClusterAddrs is set, and fails if it cannot be reached.
+// Sessions go to config.SessionStore if set, otherwise to Redis as well.
+func NewServer(config *Config) (*Server, error) {
+	if config.TokenMode != TokenModeSession && config.TokenMode != TokenModeJWT {
+		return nil, fmt.Errorf("unknown token mode %q", config.TokenMode)
+	}
+	if config.SessionLimitPolicy != SessionLimitReject && config.SessionLimitPolicy != SessionLimitEvictOldest {
+		return nil, fmt.Errorf("unknown session limit policy %q", config.SessionLimitPolicy)
+	}
+	switch config.AnomalyPolicy {
+	case AnomalyPolicyOff, AnomalyPolicyStepUp, AnomalyPolicyRevoke:
+	default:
+		return nil, fmt.Errorf("unknown anomaly policy %q", config.AnomalyPolicy)
+	}
+	if config.AnomalyIPv4Prefix < 0 || config.AnomalyIPv4Prefix > 32 || config.AnomalyIPv6Prefix < 0 || config.AnomalyIPv6Prefix > 128 {
+		return nil, errors.New("anomaly IP prefix lengths out of range")
+	}
+	for _, rule := range config.AnomalyRules {
+		if rule != AnomalyRuleIPRange && rule != AnomalyRuleUserAgent {
+			return nil, fmt.Errorf("unknown anomaly rule %q", rule)
+		}
+	}
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring *Keyring
+	if len(config.SessionKeys) > 0 {
+		var err error
+		if keyring, err = ParseKeyring(config.SessionKeys); err != nil {
+			return nil, fmt.Errorf("session keys: %w", err)
+		}
+	}
+
+	// A client passed in Config.Redis belongs to the caller and is never
+	// closed here
+	rdb := config.Redis
+	closeRedis := func() {
+		if config.Redis == nil {
+			rdb.Close()
+		}
+	}
+	sessions := config.SessionStore
+	switch {
+	case rdb != nil:
+		if sessions == nil {
+			sessions = &RedisSessionStore{client: rdb, keyring: keyring}
+		}
+	case len(config.RedisClusterAddrs) > 0:
+		cluster := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs: config.RedisClusterAddrs,
+		})
+		if sessions == nil {
+			sessions = NewClusterSessionStore(cluster, keyring)
+		}
+		rdb = cluster
+	default:
+		client := redis.NewClient(&redis.Options{
+			Addr: config.RedisAddr, // Redis server address
+		})
+		if sessions == nil {
+			sessions = NewRedisSessionStore(client, keyring)
+		}
+		rdb = client
+	}
 
-	// Optionally, you can test the connection here
 	if err := rdb.Ping(context.Background()).Err(); err != nil {
-		panic(err) // Handle error appropriately
+		closeRedis()
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+
+	mailer := config.Mailer
+	if mailer == nil {
+		mailer = NewFileMailer(config.MailDir)
+	}
+
+	magicLinkSecret := []byte(config.MagicLinkSecret)
+	if len(magicLinkSecret) == 0 {
+		magicLinkSecret = make([]byte, 32)
+		if _, err := rand.Read(magicLinkSecret); err != nil {
+			return nil, err
+		}
 	}
 
-	return &Server{redis: rdb}
+	server := &Server{
+		redis:    rdb,
+		sessions: sessions,
+		config:   config,
+		mailer:   mailer,
+		oidc:     newOIDCProvider(),
+		keyring:  keyring,
+
+		trustedProxies:  trustedProxies,
+		magicLinkSecret: magicLinkSecret,
+	}
+	if config.TokenMode == TokenModeJWT {
+		if err := server.ensureSigningKey(context.Background()); err != nil {
+			closeRedis()
+			return nil, fmt.Errorf("creating signing key: %w", err)
+		}
+	}
+	return server, nil
 }
 
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -49,68 +187,217 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Hash the password for the mock user
-	storedHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	// Refuse the attempt while the email or IP is delayed or locked out
+	ip := s.clientIP(r)
+	wait, err := s.loginRetryAfter(r.Context(), loginReq.Email, ip)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-
-	mockUser := &Session{
-		UserID:    "1",
-		Email:     "test@example.com",
-		CreatedAt: time.Now(),
+	if wait > 0 {
+		s.audit(r.Context(), r, AuditEvent{
+			Type:    AuditLogin,
+			Actor:   normalizeEmail(loginReq.Email),
+			IP:      ip,
+			Outcome: AuditFailure,
+			Detail:  "throttled",
+		})
+		writeRetryAfter(w, wait)
+		return
 	}
 
-	// Verify password
-	if err := bcrypt.CompareHashAndPassword(storedHash, []byte(loginReq.Password)); err != nil {
+	user, err := s.authenticate(r.Context(), loginReq.Email, loginReq.Password)
+	if errors.Is(err, ErrUserNotFound) {
+		s.audit(r.Context(), r, AuditEvent{
+			Type:    AuditLogin,
+			Actor:   normalizeEmail(loginReq.Email),
+			IP:      ip,
+			Outcome: AuditFailure,
+			Detail:  "invalid credentials",
+		})
+		if err := s.recordLoginFailure(r.Context(), loginReq.Email, ip); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	// With TOTP the login is not over yet; failed codes keep counting
+	// against the same lockout until /api/2fa/verify succeeds
+	if !user.TOTPEnabled {
+		s.clearLoginFailures(r.Context(), loginReq.Email)
+	}
 
 	fmt.Println("Login successful")
-	// Generate session token
-	sessionToken, err := s.generateSessionToken()
+	s.finishLogin(w, r, user, "password")
+}
+
+// finishLogin is called once the user's primary credential, named by method,
+// checked out. It starts a session, or parks the login until /api/2fa/verify
+// if the user has TOTP enabled.
+func (s *Server) finishLogin(w http.ResponseWriter, r *http.Request, user *User, method string) {
+	if user.TOTPEnabled {
+		pendingToken, err := s.startTwoFactorLogin(r.Context(), user)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"two_factor_required": true,
+			"pending_token":       pendingToken,
+			"message":             "Two-factor code required",
+		})
+		return
+	}
+
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditLogin,
+		UserID:  user.ID,
+		Actor:   user.ID,
+		Outcome: AuditSuccess,
+		Detail:  method,
+	})
+	s.completeLogin(w, r, user, "")
+}
+
+// completeLogin starts an access session for an authenticated user, pairs it
+// with a refresh token from the given family (a new family when familyID is
+// empty) and writes both to the response.
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, user *User, familyID string) {
+	var err error
+	refreshing := familyID != ""
+	if !refreshing {
+		if familyID, err = s.generateToken(); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Create session and add it to the user's session index
+	session := s.newSession(r, user)
+	session.RefreshFamily = familyID
+	if refreshing {
+		if err := s.restoreFamilyOrigin(r.Context(), familyID, session); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	session.Roles, session.Permissions, err = s.userPermissions(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if s.config.CookieMode {
+		csrfToken, err := s.generateToken()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		session.CSRFToken = csrfToken
+	}
+	var sessionToken string
+	if s.config.TokenMode == TokenModeJWT {
+		sessionToken, err = s.issueSessionJWT(r.Context(), session)
+	} else {
+		sessionToken, err = s.createSession(r.Context(), session)
+	}
+	if errors.Is(err, ErrSessionLimitReached) {
+		http.Error(w, "Too many active sessions; log out on another device first", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-	fmt.Println("Session token:", sessionToken)
+	// Only real logins make a network and device known; a stolen refresh
+	// token must not vouch for wherever it is used
+	if !refreshing {
+		if err := s.rememberDevice(r.Context(), user.ID, session.IP, session.UserAgent); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Create session
-	sessionJSON, _ := json.Marshal(mockUser)
-	err = s.redis.Set(r.Context(), "session:"+sessionToken, sessionJSON, 24*time.Hour).Err()
+	refreshToken, err := s.issueRefreshToken(r.Context(), familyID, sessionToken, session)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Respond with session token
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"session_token": sessionToken,
-		"message":       "Login successful",
+	if s.config.CookieMode {
+		// The tokens only travel in HttpOnly cookies
+		s.setSessionCookies(w, sessionToken, refreshToken, session)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"csrf_token":          session.CSRFToken,
+			"expires_at":          session.ExpiresAt,
+			"absolute_expires_at": session.AbsoluteExpiresAt,
+			"message":             "Login successful",
+		})
+		return
+	}
+
+	// Respond with session and refresh tokens
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"session_token":       sessionToken,
+		"refresh_token":       refreshToken,
+		"expires_at":          session.ExpiresAt,
+		"absolute_expires_at": session.AbsoluteExpiresAt,
+		"message":             "Login successful",
 	})
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	// Get session token from request body instead of cookie
+	// Get session token from request body, falling back to the Authorization
+	// header or session cookie
 	var logoutReq struct {
 		SessionToken string `json:"session_token"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&logoutReq); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&logoutReq); err != nil && err != io.EOF {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	fromCookie := false
+	if logoutReq.SessionToken == "" {
+		logoutReq.SessionToken, fromCookie = tokenFromRequest(r)
+	}
 
-	fmt.Println("Logout request:", logoutReq.SessionToken)
-
-	// Delete session from Redis
-	err := s.redis.Del(r.Context(), "session:"+logoutReq.SessionToken).Err()
+	session, err := s.lookupSession(r.Context(), logoutReq.SessionToken)
+	if errors.Is(err, ErrSessionNotFound) {
+		s.clearSessionCookies(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
+	if fromCookie && csrfRequired(r) && !validCSRF(r, session.CSRFToken) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	// Delete session and its refresh tokens from Redis
+	err = s.revokeSession(r.Context(), logoutReq.SessionToken)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.clearSessionCookies(w)
+	eventType := AuditLogout
+	if session.ImpersonatorID != "" {
+		eventType = AuditImpersonationEnded
+	}
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    eventType,
+		UserID:  session.UserID,
+		Actor:   sessionActor(session),
+		Outcome: AuditSuccess,
+		Detail:  sessionID(logoutReq.SessionToken),
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -119,40 +406,48 @@ func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleCheckAuth(w http.ResponseWriter, r *http.Request) {
-	// Get session token from the Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Retrieve the session named by the Bearer token in the Authorization header
+	token, session, err := s.authenticatedSession(r)
+	if errors.Is(err, ErrStepUpRequired) {
+		writeStepUpRequired(w)
 		return
 	}
-
-	// Extract the token from the header (assuming Bearer token format)
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-	if token == "" {
+	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-
-	// Retrieve the session using the token
-	sessionData, err := s.redis.Get(r.Context(), "session:"+token).Result()
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Services checking a request on a user's behalf call with the
+	// request's method, so cookie-authenticated writes need the CSRF token
+	if csrfRequired(r) && !validCSRF(r, session.CSRFToken) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
 		return
 	}
-
-	var session Session
-	if err := json.Unmarshal([]byte(sessionData), &session); err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !s.checkSessionAnomalies(w, r, token, session) {
 		return
 	}
 
-	fmt.Println("Session:", session)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(session)
 }
 
-func (s *Server) generateSessionToken() (string, error) {
+// deleteKeys deletes each key with its own DEL, so keys that hash to
+// different cluster slots can be deleted together.
+func (s *Server) deleteKeys(ctx context.Context, keys ...string) error {
+	pipe := s.redis.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) generateToken() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
 		return "", err
@@ -196,6 +491,7 @@ func (h *CheckAuthHandler) HandleCheckAuth(w http.ResponseWriter, r *http.Reques
 	h.server.handleCheckAuth(w, r)
 }
 
+// ProtectedHandler is an example endpoint mounted behind RequireSession.
 type ProtectedHandler struct{}
 
 func NewProtectedHandler() *ProtectedHandler {
@@ -203,7 +499,14 @@ func NewProtectedHandler() *ProtectedHandler {
 }
 
 func (p *ProtectedHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	session, ok := SessionFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "This is a protected endpoint",
+		"user_id": session.UserID,
 	})
 }
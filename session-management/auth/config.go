@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type Config struct {
+	RedisAddr string
+	// RedisClusterAddrs switches to Redis Cluster when set; RedisAddr is
+	// then ignored.
+	RedisClusterAddrs []string
+	// Redis is used instead of connecting to RedisAddr or
+	// RedisClusterAddrs when set, e.g. a client of a miniredis in tests.
+	Redis redis.UniversalClient
+	// SessionStore overrides where sessions are kept, e.g. a
+	// MemorySessionStore in tests. Everything else stays in Redis.
+	SessionStore SessionStore
+	// TokenMode is "session" for opaque tokens naming a session in Redis, or
+	// "jwt" for signed access tokens that are valid for JWTTTL and can be
+	// verified with the keys published at /.well-known/jwks.json.
+	TokenMode   string
+	JWTIssuer   string
+	JWTAudience string
+	JWTTTL      time.Duration
+	// SessionKeys encrypt sessions stored in Redis, as "id:base64key"
+	// entries. The first key encrypts, all of them decrypt, so a key is
+	// rotated by putting a new one in front and re-encrypting. Sessions are
+	// stored in plaintext while this is empty.
+	SessionKeys []string
+
+	// IdleTimeout is how long a session survives without being used. Every
+	// authenticated request pushes the expiry out by this much again.
+	IdleTimeout time.Duration
+	// MaxLifetime caps how long an access session can live regardless of
+	// activity. Clients holding a refresh token get a new session from
+	// /api/refresh instead of logging in again.
+	MaxLifetime time.Duration
+	// RefreshTokenTTL is how long an unused refresh token stays valid. Each
+	// rotation issues a new token with a fresh TTL.
+	RefreshTokenTTL time.Duration
+	// MaxSessionsPerUser caps how many sessions a user may hold at once; 0
+	// means no cap. SessionLimitPolicy says what a login past the cap does:
+	// "reject" turns it away, "evict_oldest" revokes the oldest sessions to
+	// make room. JWT mode keeps no session index, so it is not capped.
+	MaxSessionsPerUser int
+	SessionLimitPolicy string
+
+	// Failed logins are counted per email and per client IP within
+	// LoginFailureWindow. From LoginDelayAfter failures on, every further
+	// attempt has to wait an exponentially growing delay; at LoginMaxFailures
+	// the email or IP is locked out for LockoutDuration.
+	LoginFailureWindow time.Duration
+	LoginDelayAfter    int
+	LoginMaxFailures   int
+	LockoutDuration    time.Duration
+
+	// TOTPIssuer names this service in authenticator apps.
+	TOTPIssuer string
+	// PendingTwoFactorTTL is how long a password-verified login waits for
+	// its TOTP or recovery code.
+	PendingTwoFactorTTL time.Duration
+
+	// PublicURL is where users reach the frontend; links in emails point
+	// there.
+	PublicURL        string
+	PasswordResetTTL time.Duration
+	// MailDir is where the default FileMailer drops outgoing emails. Set
+	// Mailer to deliver them some other way, e.g. a MemoryMailer in tests.
+	MailDir string
+	Mailer  Mailer
+
+	// Magic links log users in by email. MagicLinkSecret signs them; while
+	// it is empty a random secret is used, so links only work on the
+	// instance that sent them and until it restarts. Each email can request
+	// MagicLinkMaxRequests links per MagicLinkRateWindow.
+	MagicLinkTTL         time.Duration
+	MagicLinkSecret      string
+	MagicLinkMaxRequests int
+	MagicLinkRateWindow  time.Duration
+
+	// CookieMode delivers session and refresh tokens as HttpOnly cookies
+	// instead of in the JSON response, together with a CSRF token that
+	// state-changing requests have to echo back.
+	CookieMode     bool
+	CookieSecure   bool
+	CookieSameSite string
+
+	// APIKeyTTL is how long API keys are valid unless issued with another
+	// expiry.
+	APIKeyTTL time.Duration
+
+	// ImpersonationTTL is how long an admin's impersonation session lasts.
+	// It is not extended by activity beyond that.
+	ImpersonationTTL time.Duration
+
+	// AnomalyPolicy decides what /api/check-auth does with a session used
+	// from a network or device that is neither where it was created nor
+	// known for the user: "off" ignores it, "step_up" makes the user
+	// re-authenticate at /api/step-up, "revoke" ends the session and emails
+	// the user. AnomalyRules picks what is compared, "ip_range" and/or
+	// "user_agent"; IP addresses are compared by network, with the prefix
+	// lengths below. Logins are remembered as known for KnownDeviceTTL.
+	AnomalyPolicy     string
+	AnomalyRules      []string
+	AnomalyIPv4Prefix int
+	AnomalyIPv6Prefix int
+	KnownDeviceTTL    time.Duration
+
+	// The audit log keeps about AuditMaxLen events and drops those older
+	// than AuditRetention; either limit is off when zero.
+	AuditMaxLen    int64
+	AuditRetention time.Duration
+
+	// AdminToken, sent in the X-Admin-Token header, authorizes the admin
+	// endpoints just like a session with the auth:admin permission. It is
+	// ignored while empty.
+	AdminToken string
+	// TrustProxyHeaders makes the client IP come from X-Forwarded-For. Only
+	// enable it when the server is reachable solely through a proxy.
+	TrustProxyHeaders bool
+	// TrustedProxies lists the addresses or CIDR ranges, such as the
+	// frontend and the services calling /api/check-auth, whose
+	// X-Forwarded-For is honoured. It defaults to loopback.
+	TrustedProxies []string
+
+	// OIDCIssuer enables login through an OpenID Connect provider; it is
+	// disabled while empty. OIDCRedirectURL must point at /api/oidc/callback.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	// OIDCStateTTL is how long a started OIDC login may take to come back.
+	OIDCStateTTL time.Duration
+	// OIDCMockIdP serves a mock provider under /mock-idp for development.
+	// It becomes the issuer unless OIDCIssuer is set.
+	OIDCMockIdP bool
+}
+
+func LoadConfig() *Config {
+	mockIdP := getEnvAsBool("OIDC_MOCK_IDP", false)
+	defaultIssuer := ""
+	if mockIdP {
+		defaultIssuer = "http://127.0.0.1:9001/mock-idp"
+	}
+
+	anomalyRules := getEnvAsList("ANOMALY_RULES")
+	if anomalyRules == nil {
+		anomalyRules = []string{AnomalyRuleIPRange, AnomalyRuleUserAgent}
+	}
+	trustedProxies := getEnvAsList("TRUSTED_PROXIES")
+	if trustedProxies == nil {
+		trustedProxies = []string{"127.0.0.0/8", "::1/128"}
+	}
+
+	return &Config{
+		RedisAddr:         getEnv("REDIS_ADDR", "127.0.0.1:6379"),
+		RedisClusterAddrs: getEnvAsList("REDIS_CLUSTER_ADDRS"),
+		SessionKeys:       getEnvAsList("SESSION_KEYS"),
+
+		TokenMode:       getEnv("TOKEN_MODE", TokenModeSession),
+		JWTIssuer:       getEnv("JWT_ISSUER", "http://127.0.0.1:9001"),
+		JWTAudience:     getEnv("JWT_AUDIENCE", "art-of-redis"),
+		JWTTTL:          getEnvAsDuration("JWT_TTL", 15*time.Minute),
+		IdleTimeout:     getEnvAsDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		MaxLifetime:     getEnvAsDuration("SESSION_MAX_LIFETIME", time.Hour),
+		RefreshTokenTTL: getEnvAsDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+
+		MaxSessionsPerUser: getEnvAsInt("MAX_SESSIONS_PER_USER", 0),
+		SessionLimitPolicy: getEnv("SESSION_LIMIT_POLICY", SessionLimitReject),
+
+		LoginFailureWindow: getEnvAsDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginDelayAfter:    getEnvAsInt("LOGIN_DELAY_AFTER", 3),
+		LoginMaxFailures:   getEnvAsInt("LOGIN_MAX_FAILURES", 10),
+		LockoutDuration:    getEnvAsDuration("LOCKOUT_DURATION", 15*time.Minute),
+
+		TOTPIssuer:          getEnv("TOTP_ISSUER", "Art of Redis"),
+		PendingTwoFactorTTL: getEnvAsDuration("PENDING_2FA_TTL", 5*time.Minute),
+
+		PublicURL:        getEnv("PUBLIC_URL", "http://127.0.0.1:5001"),
+		PasswordResetTTL: getEnvAsDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+		MailDir:          getEnv("MAIL_DIR", "mail"),
+
+		MagicLinkTTL:         getEnvAsDuration("MAGIC_LINK_TTL", 15*time.Minute),
+		MagicLinkSecret:      getEnv("MAGIC_LINK_SECRET", ""),
+		MagicLinkMaxRequests: getEnvAsInt("MAGIC_LINK_MAX_REQUESTS", 3),
+		MagicLinkRateWindow:  getEnvAsDuration("MAGIC_LINK_RATE_WINDOW", 15*time.Minute),
+
+		CookieMode:     getEnvAsBool("COOKIE_MODE", false),
+		CookieSecure:   getEnvAsBool("COOKIE_SECURE", true),
+		CookieSameSite: getEnv("COOKIE_SAMESITE", "lax"),
+
+		APIKeyTTL: getEnvAsDuration("API_KEY_TTL", 90*24*time.Hour),
+
+		ImpersonationTTL: getEnvAsDuration("IMPERSONATION_TTL", 15*time.Minute),
+
+		AnomalyPolicy:     getEnv("ANOMALY_POLICY", AnomalyPolicyOff),
+		AnomalyRules:      anomalyRules,
+		AnomalyIPv4Prefix: getEnvAsInt("ANOMALY_IPV4_PREFIX", 24),
+		AnomalyIPv6Prefix: getEnvAsInt("ANOMALY_IPV6_PREFIX", 48),
+		KnownDeviceTTL:    getEnvAsDuration("KNOWN_DEVICE_TTL", 90*24*time.Hour),
+
+		AuditMaxLen:    int64(getEnvAsInt("AUDIT_MAX_LEN", 100000)),
+		AuditRetention: getEnvAsDuration("AUDIT_RETENTION", 90*24*time.Hour),
+
+		AdminToken:        getEnv("ADMIN_TOKEN", ""),
+		TrustProxyHeaders: getEnvAsBool("TRUST_PROXY_HEADERS", false),
+		TrustedProxies:    trustedProxies,
+
+		OIDCIssuer:       getEnv("OIDC_ISSUER", defaultIssuer),
+		OIDCClientID:     getEnv("OIDC_CLIENT_ID", "session-management"),
+		OIDCClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:  getEnv("OIDC_REDIRECT_URL", "http://127.0.0.1:9001/api/oidc/callback"),
+		OIDCStateTTL:     getEnvAsDuration("OIDC_STATE_TTL", 10*time.Minute),
+		OIDCMockIdP:      mockIdP,
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvAsList splits a comma-separated value, skipping empty items.
+func getEnvAsList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvAsInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intVal, err := strconv.Atoi(value); err == nil {
+			return intVal
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+// In cookie mode the session and refresh tokens never reach JavaScript: they
+// travel in HttpOnly cookies. Because browsers attach those cookies to
+// cross-site requests too, state-changing requests must also echo the
+// session's CSRF token, which is readable from the csrf_token cookie, in the
+// X-CSRF-Token header.
+const (
+	RefreshCookieName = "refresh_token"
+	CSRFCookieName    = "csrf_token"
+	CSRFHeaderName    = "X-CSRF-Token"
+
+	refreshCookiePath = "/api/refresh"
+)
+
+func (s *Server) sameSite() http.SameSite {
+	switch s.config.CookieSameSite {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// setSessionCookies hands the session, refresh and CSRF tokens to the browser.
+// The session cookie lives as long as the session can; the server still
+// enforces the idle timeout.
+func (s *Server) setSessionCookies(w http.ResponseWriter, sessionToken, refreshToken string, session *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    sessionToken,
+		Path:     "/",
+		Expires:  session.AbsoluteExpiresAt,
+		HttpOnly: true,
+		Secure:   s.config.CookieSecure,
+		SameSite: s.sameSite(),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookieName,
+		Value:    refreshToken,
+		Path:     refreshCookiePath,
+		Expires:  time.Now().Add(s.config.RefreshTokenTTL),
+		HttpOnly: true,
+		Secure:   s.config.CookieSecure,
+		SameSite: s.sameSite(),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    session.CSRFToken,
+		Path:     "/",
+		Expires:  time.Now().Add(s.config.RefreshTokenTTL),
+		Secure:   s.config.CookieSecure,
+		SameSite: s.sameSite(),
+	})
+}
+
+func (s *Server) clearSessionCookies(w http.ResponseWriter) {
+	for _, cookie := range []struct{ name, path string }{
+		{SessionCookieName, "/"},
+		{RefreshCookieName, refreshCookiePath},
+		{CSRFCookieName, "/"},
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookie.name,
+			Value:    "",
+			Path:     cookie.path,
+			MaxAge:   -1,
+			HttpOnly: cookie.name != CSRFCookieName,
+			Secure:   s.config.CookieSecure,
+			SameSite: s.sameSite(),
+		})
+	}
+}
+
+// csrfRequired reports whether the request needs a CSRF token: it changes
+// state and its session token is read from the session cookie. A token the
+// client sent itself, in the Authorization header or a request body, cannot
+// be forged by another site.
+func csrfRequired(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	_, fromCookie := tokenFromRequest(r)
+	return fromCookie
+}
+
+// validCSRF checks the double-submitted CSRF token: the header has to match
+// the cookie, and both have to match expected when it is set.
+func validCSRF(r *http.Request, expected string) bool {
+	header := r.Header.Get(CSRFHeaderName)
+	cookie, err := r.Cookie(CSRFCookieName)
+	if header == "" || err != nil {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+		return false
+	}
+	if expected != "" && subtle.ConstantTimeCompare([]byte(header), []byte(expected)) != 1 {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Only a session token read from the session cookie needs a CSRF token to
+// log out; one the client sent itself does not.
+func TestLogoutCSRF(t *testing.T) {
+	server, _ := newTestServer(t, func(config *Config) { config.CookieMode = false })
+	newTestUser(t, server, "alice@example.com")
+
+	tests := []struct {
+		name    string
+		request func(token string) *http.Request
+		want    int
+	}{
+		{"token in body", func(token string) *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/api/logout", strings.NewReader(`{"session_token": "`+token+`"}`))
+		}, http.StatusOK},
+		{"bearer token", func(token string) *http.Request {
+			return bearerRequest(http.MethodPost, "/api/logout", token)
+		}, http.StatusOK},
+		{"session cookie without CSRF token", func(token string) *http.Request {
+			req := httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+			req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: token})
+			return req
+		}, http.StatusForbidden},
+		{"session cookie with CSRF token", func(token string) *http.Request {
+			req := httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+			req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: token})
+			req.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: "csrf"})
+			req.Header.Set(CSRFHeaderName, "csrf")
+			return req
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		token := logIn(t, server, httptest.NewRequest(http.MethodGet, "/", nil), "alice@example.com").SessionToken
+		rec := httptest.NewRecorder()
+		NewLogoutHandler(server).HandleLogout(rec, tt.request(token))
+		if rec.Code != tt.want {
+			t.Errorf("%s: logout answered %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
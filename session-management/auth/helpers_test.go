@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const testPassword = "correct horse"
+
+// newTestServer starts a server on miniredis. configure, if not nil, adjusts
+// the default config first.
+func newTestServer(t *testing.T, configure func(*Config)) (*Server, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	config := LoadConfig()
+	config.RedisAddr = mr.Addr()
+	config.MailDir = t.TempDir()
+	if configure != nil {
+		configure(config)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, mr
+}
+
+func newTestUser(t *testing.T, server *Server, email string) *User {
+	t.Helper()
+	user, err := server.createUser(context.Background(), email, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+type testLogin struct {
+	SessionToken string `json:"session_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// logIn logs the user in with req's address and headers, taking the body
+// from the email and testPassword.
+func logIn(t *testing.T, server *Server, req *http.Request, email string) testLogin {
+	t.Helper()
+	body, _ := json.Marshal(LoginRequest{Email: email, Password: testPassword})
+	login := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(string(body)))
+	login.RemoteAddr = req.RemoteAddr
+	login.Header = req.Header.Clone()
+	rec := httptest.NewRecorder()
+	NewLoginHandler(server).HandleLogin(rec, login)
+
+	var resp testLogin
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.SessionToken == "" {
+		t.Fatalf("login answered %d without a session token", rec.Code)
+	}
+	return resp
+}
+
+// bearerRequest is a request authenticated with token.
+func bearerRequest(method, target, token string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// An impersonation session lets support staff act as a customer. It is an
+// ordinary session of the customer's with ImpersonatorID set: it ends after
+// ImpersonationTTL, gets no refresh token and cannot be used for admin
+// actions or to change how the account is secured. Starting and ending one
+// is recorded in the audit log.
+
+// impersonating reports whether the request's session is an impersonation
+// session, and if so answers it with 403. Handlers for sensitive account
+// changes call it first.
+func impersonating(w http.ResponseWriter, r *http.Request) bool {
+	session, ok := SessionFromContext(r.Context())
+	if !ok || session.ImpersonatorID == "" {
+		return false
+	}
+	http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+	return true
+}
+
+// sessionActor names whoever acts through the session for the audit log:
+// the impersonator rather than the customer for impersonation sessions.
+func sessionActor(session *Session) string {
+	if session.ImpersonatorID != "" {
+		return session.ImpersonatorID
+	}
+	return session.UserID
+}
+
+// handleImpersonate starts an impersonation session for user_id. The reason
+// is required and goes into the audit log. The session token is only
+// returned in the response, never set as a cookie, so it does not replace
+// the admin's own session in the browser.
+func (s *Server) handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var impersonateReq struct {
+		UserID string `json:"user_id"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&impersonateReq); err != nil || impersonateReq.UserID == "" || impersonateReq.Reason == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	impersonator := s.adminActor(r)
+	if impersonator == impersonateReq.UserID {
+		http.Error(w, "Cannot impersonate yourself", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.getUser(r.Context(), impersonateReq.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	session := s.newSession(r, user)
+	session.ImpersonatorID = impersonator
+	session.DeviceLabel = "Impersonated by " + impersonator
+	session.Roles, session.Permissions, err = s.userPermissions(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	// Always a stored session, even in JWT mode, so it can be ended at once
+	sessionToken, err := s.createSession(r.Context(), session)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditImpersonationStarted,
+		UserID:  user.ID,
+		Actor:   impersonator,
+		Outcome: AuditSuccess,
+		Detail:  fmt.Sprintf("session %s: %s", sessionID(sessionToken), impersonateReq.Reason),
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"session_token":   sessionToken,
+		"user_id":         user.ID,
+		"impersonator_id": impersonator,
+		"expires_at":      session.AbsoluteExpiresAt,
+		"message":         "Impersonation started",
+	})
+}
+
+type ImpersonationHandler struct {
+	server *Server
+}
+
+func NewImpersonationHandler(server *Server) *ImpersonationHandler {
+	return &ImpersonationHandler{server: server}
+}
+
+func (h *ImpersonationHandler) HandleImpersonate(w http.ResponseWriter, r *http.Request) {
+	h.server.handleImpersonate(w, r)
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// An admin impersonating a user cannot end the user's sessions.
+func TestImpersonationCannotRevokeSessions(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	handler := NewSessionsHandler(server)
+	session := &Session{UserID: "1", ImpersonatorID: "2"}
+
+	tests := []struct {
+		name   string
+		handle http.HandlerFunc
+	}{
+		{"revoke", handler.HandleRevoke},
+		{"revoke others", handler.HandleRevokeOthers},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/sessions/revoke", strings.NewReader(`{"id": "abc"}`))
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey, session))
+		rec := httptest.NewRecorder()
+		tt.handle(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s answered %d while impersonating, want 403", tt.name, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// In JWT mode access tokens are RS256-signed JWTs that other services can
+// verify against the JWK set alone. This server additionally checks a
+// denylist of revoked token IDs. Refresh tokens work as in session mode.
+
+const (
+	TokenModeSession = "session"
+	TokenModeJWT     = "jwt"
+
+	// jwtKeysKey is a hash of signing keys by kid; jwtCurrentKidKey names
+	// the one new tokens are signed with.
+	jwtKeysKey        = "jwt_keys"
+	jwtCurrentKidKey  = "jwt_current_kid"
+	jwtDenylistPrefix = "jwt_denylist:"
+
+	// jwtKeyCacheTTL bounds how long a rotation takes to reach every
+	// instance.
+	jwtKeyCacheTTL = 30 * time.Second
+	jwtKeySize     = 2048
+)
+
+// jwtSessionClaims carry what the server would otherwise keep in the
+// session.
+type jwtSessionClaims struct {
+	registeredClaims
+	Email         string   `json:"email"`
+	Roles         []string `json:"roles"`
+	Permissions   []string `json:"permissions"`
+	RefreshFamily string   `json:"fam,omitempty"`
+	CSRFToken     string   `json:"csrf,omitempty"`
+}
+
+// storedSigningKey is a signing key as kept in Redis. The private key is
+// sealed with the session keyring if there is one.
+type storedSigningKey struct {
+	PrivateKey []byte `json:"private_key"`
+	CreatedAt  int64  `json:"created_at"`
+	// RetiresAt is set once the key has been replaced: it stays in the JWK
+	// set until every token it signed has expired.
+	RetiresAt int64 `json:"retires_at,omitempty"`
+}
+
+type signingKey struct {
+	kid       string
+	key       *rsa.PrivateKey
+	createdAt time.Time
+	retiresAt time.Time
+}
+
+// signingKeys caches the keys from Redis.
+type signingKeys struct {
+	mu       sync.Mutex
+	loadedAt time.Time
+	current  string
+	keys     map[string]*signingKey
+}
+
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (s *Server) sealSigningKey(kid string, key *rsa.PrivateKey) ([]byte, error) {
+	der := x509.MarshalPKCS1PrivateKey(key)
+	if s.keyring == nil {
+		return der, nil
+	}
+	return s.keyring.Seal(der, []byte(jwtKeysKey+":"+kid))
+}
+
+func (s *Server) openSigningKey(kid string, sealed []byte) (*rsa.PrivateKey, error) {
+	der := sealed
+	if IsSealed(sealed) {
+		if s.keyring == nil {
+			return nil, ErrUnknownKey
+		}
+		var err error
+		if der, err = s.keyring.Open(sealed, []byte(jwtKeysKey+":"+kid)); err != nil {
+			return nil, err
+		}
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// newSigningKey generates a key and stores it, without making it current.
+func (s *Server) newSigningKey(ctx context.Context) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, jwtKeySize)
+	if err != nil {
+		return "", err
+	}
+	kid, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := s.sealSigningKey(kid, key)
+	if err != nil {
+		return "", err
+	}
+
+	stored, err := json.Marshal(storedSigningKey{PrivateKey: sealed, CreatedAt: time.Now().Unix()})
+	if err != nil {
+		return "", err
+	}
+	if err := s.redis.HSet(ctx, jwtKeysKey, kid, stored).Err(); err != nil {
+		return "", err
+	}
+	return kid, nil
+}
+
+// ensureSigningKey creates the first signing key unless there already is
+// one. When several instances start at once, only one key wins.
+func (s *Server) ensureSigningKey(ctx context.Context) error {
+	exists, err := s.redis.Exists(ctx, jwtCurrentKidKey).Result()
+	if err != nil || exists == 1 {
+		return err
+	}
+
+	kid, err := s.newSigningKey(ctx)
+	if err != nil {
+		return err
+	}
+	won, err := s.redis.SetNX(ctx, jwtCurrentKidKey, kid, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !won {
+		return s.redis.HDel(ctx, jwtKeysKey, kid).Err()
+	}
+	return nil
+}
+
+// rotateSigningKey makes a new key current and retires the previous one
+// once the tokens it signed have expired. Keys past retirement are removed.
+func (s *Server) rotateSigningKey(ctx context.Context) (string, error) {
+	kid, err := s.newSigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	previous, err := s.redis.GetSet(ctx, jwtCurrentKidKey, kid).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	stored, err := s.redis.HGetAll(ctx, jwtKeysKey).Result()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	for storedKid, value := range stored {
+		var key storedSigningKey
+		if err := json.Unmarshal([]byte(value), &key); err != nil {
+			return "", err
+		}
+		switch {
+		case storedKid == previous && key.RetiresAt == 0:
+			key.RetiresAt = now.Add(s.config.JWTTTL).Unix()
+			updated, err := json.Marshal(key)
+			if err != nil {
+				return "", err
+			}
+			if err := s.redis.HSet(ctx, jwtKeysKey, storedKid, updated).Err(); err != nil {
+				return "", err
+			}
+		case key.RetiresAt != 0 && now.Unix() >= key.RetiresAt:
+			if err := s.redis.HDel(ctx, jwtKeysKey, storedKid).Err(); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// Sign with the new key right away on this instance
+	s.jwtKeys.mu.Lock()
+	s.jwtKeys.loadedAt = time.Time{}
+	s.jwtKeys.mu.Unlock()
+	return kid, nil
+}
+
+// loadSigningKeys returns the cached keys, reloading them from Redis when
+// the cache is stale or force is set. The caller must hold s.jwtKeys.mu.
+func (s *Server) loadSigningKeys(ctx context.Context, force bool) error {
+	if !force && time.Since(s.jwtKeys.loadedAt) < jwtKeyCacheTTL {
+		return nil
+	}
+
+	current, err := s.redis.Get(ctx, jwtCurrentKidKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	stored, err := s.redis.HGetAll(ctx, jwtKeysKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*signingKey, len(stored))
+	for kid, value := range stored {
+		var storedKey storedSigningKey
+		if err := json.Unmarshal([]byte(value), &storedKey); err != nil {
+			return err
+		}
+		key, err := s.openSigningKey(kid, storedKey.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", kid, err)
+		}
+		keys[kid] = &signingKey{kid: kid, key: key, createdAt: time.Unix(storedKey.CreatedAt, 0)}
+		if storedKey.RetiresAt != 0 {
+			keys[kid].retiresAt = time.Unix(storedKey.RetiresAt, 0)
+		}
+	}
+
+	s.jwtKeys.current = current
+	s.jwtKeys.keys = keys
+	s.jwtKeys.loadedAt = time.Now()
+	return nil
+}
+
+func (s *Server) currentSigningKey(ctx context.Context) (*signingKey, error) {
+	s.jwtKeys.mu.Lock()
+	defer s.jwtKeys.mu.Unlock()
+	if err := s.loadSigningKeys(ctx, false); err != nil {
+		return nil, err
+	}
+	key, ok := s.jwtKeys.keys[s.jwtKeys.current]
+	if !ok {
+		return nil, errors.New("no current signing key")
+	}
+	return key, nil
+}
+
+// verificationKey returns the public key for kid, reloading the keys if kid
+// is unknown because another instance just rotated. Reloads are throttled so
+// that tokens with made-up kids cannot hammer Redis.
+func (s *Server) verificationKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	s.jwtKeys.mu.Lock()
+	defer s.jwtKeys.mu.Unlock()
+	if err := s.loadSigningKeys(ctx, false); err != nil {
+		return nil, err
+	}
+	key, ok := s.jwtKeys.keys[kid]
+	if !ok && time.Since(s.jwtKeys.loadedAt) > time.Second {
+		if err := s.loadSigningKeys(ctx, true); err != nil {
+			return nil, err
+		}
+		key, ok = s.jwtKeys.keys[kid]
+	}
+	if !ok {
+		return nil, ErrInvalidJWT
+	}
+	return &key.key.PublicKey, nil
+}
+
+// issueSessionJWT stamps the session's timestamps and returns it as a
+// signed token. There is no idle timeout: the token is valid for JWTTTL.
+func (s *Server) issueSessionJWT(ctx context.Context, session *Session) (string, error) {
+	key, err := s.currentSigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	jti, err := s.generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	session.AbsoluteExpiresAt = now.Add(s.config.JWTTTL)
+	session.ExpiresAt = session.AbsoluteExpiresAt
+
+	return signJWT(key.key, key.kid, jwtSessionClaims{
+		registeredClaims: registeredClaims{
+			Issuer:    s.config.JWTIssuer,
+			Subject:   session.UserID,
+			Audience:  audience{s.config.JWTAudience},
+			ExpiresAt: session.ExpiresAt.Unix(),
+			IssuedAt:  now.Unix(),
+			ID:        jti,
+		},
+		Email:         session.Email,
+		Roles:         session.Roles,
+		Permissions:   session.Permissions,
+		RefreshFamily: session.RefreshFamily,
+		CSRFToken:     session.CSRFToken,
+	})
+}
+
+// parseSessionJWT verifies a token this server issued, without consulting
+// the denylist.
+func (s *Server) parseSessionJWT(ctx context.Context, token string) (*jwtSessionClaims, error) {
+	var claims jwtSessionClaims
+	_, err := parseJWT(token, func(kid string) (*rsa.PublicKey, error) {
+		return s.verificationKey(ctx, kid)
+	}, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.validate(s.config.JWTIssuer, s.config.JWTAudience, time.Now()); err != nil {
+		return nil, err
+	}
+	if claims.ID == "" || claims.Subject == "" {
+		return nil, ErrInvalidJWT
+	}
+	return &claims, nil
+}
+
+// verifySessionJWT returns the session a token stands for. Invalid,
+// expired and revoked tokens are reported as ErrSessionNotFound.
+func (s *Server) verifySessionJWT(ctx context.Context, token string) (*Session, error) {
+	claims, err := s.parseSessionJWT(ctx, token)
+	if errors.Is(err, ErrInvalidJWT) || errors.Is(err, ErrExpiredJWT) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	denied, err := s.redis.Exists(ctx, jwtDenylistPrefix+claims.ID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if denied == 1 {
+		return nil, ErrSessionNotFound
+	}
+
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	return &Session{
+		UserID:            claims.Subject,
+		Email:             claims.Email,
+		CreatedAt:         issuedAt,
+		LastSeenAt:        issuedAt,
+		ExpiresAt:         expiresAt,
+		AbsoluteExpiresAt: expiresAt,
+		RefreshFamily:     claims.RefreshFamily,
+		CSRFToken:         claims.CSRFToken,
+		Roles:             claims.Roles,
+		Permissions:       claims.Permissions,
+	}, nil
+}
+
+// denySessionJWT revokes a token by putting its ID on the denylist for as
+// long as the token would otherwise remain valid.
+func (s *Server) denySessionJWT(ctx context.Context, token string) error {
+	claims, err := s.parseSessionJWT(ctx, token)
+	if errors.Is(err, ErrInvalidJWT) || errors.Is(err, ErrExpiredJWT) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.redis.Set(ctx, jwtDenylistPrefix+claims.ID, 1, time.Until(time.Unix(claims.ExpiresAt, 0))).Err()
+}
+
+// handleJWKS publishes the public signing keys, including retiring ones
+// whose tokens may still be in circulation.
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if s.config.TokenMode != TokenModeJWT {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.jwtKeys.mu.Lock()
+	err := s.loadSigningKeys(r.Context(), false)
+	keys := make([]*signingKey, 0, len(s.jwtKeys.keys))
+	for _, key := range s.jwtKeys.keys {
+		keys = append(keys, key)
+	}
+	s.jwtKeys.mu.Unlock()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].createdAt.After(keys[j].createdAt)
+	})
+	set := JWKSet{Keys: []JWK{}}
+	now := time.Now()
+	for _, key := range keys {
+		if key.retiresAt.IsZero() || now.Before(key.retiresAt) {
+			set.Keys = append(set.Keys, newJWK(key.kid, &key.key.PublicKey))
+		}
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwtKeyCacheTTL/time.Second)))
+	writeJSON(w, http.StatusOK, set)
+}
+
+func (s *Server) handleRotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	if s.config.TokenMode != TokenModeJWT {
+		http.Error(w, "JWT mode is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	kid, err := s.rotateSigningKey(r.Context())
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"kid":     kid,
+		"message": "Signing key rotated",
+	})
+}
+
+type JWKSHandler struct {
+	server *Server
+}
+
+func NewJWKSHandler(server *Server) *JWKSHandler {
+	return &JWKSHandler{server: server}
+}
+
+func (h *JWKSHandler) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	h.server.handleJWKS(w, r)
+}
+
+func (h *JWKSHandler) HandleRotate(w http.ResponseWriter, r *http.Request) {
+	h.server.handleRotateSigningKey(w, r)
+}
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKeyOnce sync.Once
+	testRSAKeys    [2]*rsa.PrivateKey
+)
+
+// testRSAKey returns one of two keys generated once per test run.
+func testRSAKey(t *testing.T, i int) *rsa.PrivateKey {
+	t.Helper()
+	testRSAKeyOnce.Do(func() {
+		for j := range testRSAKeys {
+			key, err := rsa.GenerateKey(rand.Reader, jwtKeySize)
+			if err != nil {
+				panic(err)
+			}
+			testRSAKeys[j] = key
+		}
+	})
+	return testRSAKeys[i]
+}
+
+func TestParseJWT(t *testing.T) {
+	key, other := testRSAKey(t, 0), testRSAKey(t, 1)
+	keyFor := func(kid string) (*rsa.PublicKey, error) {
+		if kid != "k1" {
+			return nil, ErrInvalidJWT
+		}
+		return &key.PublicKey, nil
+	}
+	claims := registeredClaims{Issuer: "iss", Subject: "42", Audience: audience{"aud"}, ExpiresAt: 2000000000}
+	token, err := signJWT(key, "k1", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byOther, _ := signJWT(other, "k1", claims)
+	unknownKid, _ := signJWT(key, "k2", claims)
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(registeredClaims{Issuer: "iss", Subject: "1", Audience: audience{"aud"}, ExpiresAt: 2000000000})
+	noneHeader, _ := json.Marshal(jwtHeader{Alg: "none", Typ: "JWT", Kid: "k1"})
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", token, true},
+		{"signed with another key", byOther, false},
+		{"unknown kid", unknownKid, false},
+		{"claims swapped", parts[0] + "." + b64.EncodeToString(forged) + "." + parts[2], false},
+		{"alg none", b64.EncodeToString(noneHeader) + "." + parts[1] + ".", false},
+		{"signature stripped", parts[0] + "." + parts[1] + ".", false},
+		{"two parts", parts[0] + "." + parts[1], false},
+		{"not a token", "session-token", false},
+	}
+	for _, tt := range tests {
+		var got registeredClaims
+		header, err := parseJWT(tt.token, keyFor, &got)
+		if tt.ok && (err != nil || got.Subject != "42" || header.Kid != "k1") {
+			t.Errorf("%s: parsed %+v, %v", tt.name, got, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestRegisteredClaimsValidate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := registeredClaims{Issuer: "iss", Audience: audience{"other", "aud"}, ExpiresAt: now.Unix() + 60}
+
+	tests := []struct {
+		name   string
+		modify func(*registeredClaims)
+		want   error
+	}{
+		{"valid", func(*registeredClaims) {}, nil},
+		{"wrong issuer", func(c *registeredClaims) { c.Issuer = "evil" }, ErrInvalidJWT},
+		{"wrong audience", func(c *registeredClaims) { c.Audience = audience{"other"} }, ErrInvalidJWT},
+		{"no audience", func(c *registeredClaims) { c.Audience = nil }, ErrInvalidJWT},
+		{"expires now", func(c *registeredClaims) { c.ExpiresAt = now.Unix() }, ErrExpiredJWT},
+		{"expired", func(c *registeredClaims) { c.ExpiresAt = now.Unix() - 1 }, ErrExpiredJWT},
+	}
+	for _, tt := range tests {
+		claims := valid
+		tt.modify(&claims)
+		if err := claims.validate("iss", "aud", now); !errors.Is(err, tt.want) {
+			t.Errorf("%s: returned %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestAudienceForms(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{`{"aud": "aud"}`, "aud"},
+		{`{"aud": ["other", "aud"]}`, "aud"},
+	}
+	for _, tt := range tests {
+		var claims registeredClaims
+		if err := json.Unmarshal([]byte(tt.json), &claims); err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		if !claims.Audience.contains(tt.want) {
+			t.Errorf("%s: audience %v lacks %q", tt.json, claims.Audience, tt.want)
+		}
+	}
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+	key := testRSAKey(t, 0)
+	jwk := newJWK("k1", &key.PublicKey)
+	if jwk.Kty != "RSA" || jwk.Alg != "RS256" || jwk.Use != "sig" || jwk.E != "AQAB" {
+		t.Errorf("JWK is %+v", jwk)
+	}
+	public, err := jwk.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !public.Equal(&key.PublicKey) {
+		t.Error("public key changed on the way through the JWK")
+	}
+
+	jwk.Kty = "EC"
+	if _, err := jwk.publicKey(); err == nil {
+		t.Error("a non-RSA JWK was accepted")
+	}
+}
+
+func fetchJWKS(t *testing.T, server *Server) JWKSet {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	NewJWKSHandler(server).HandleJWKS(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	var set JWKSet
+	if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+		t.Fatalf("JWKS answered %d: %v", rec.Code, err)
+	}
+	return set
+}
+
+// verifyWithJWKS checks token the way another service would, with nothing
+// but the published key set.
+func verifyWithJWKS(set JWKSet, token string) error {
+	var claims jwtSessionClaims
+	_, err := parseJWT(token, func(kid string) (*rsa.PublicKey, error) {
+		for _, jwk := range set.Keys {
+			if jwk.Kid == kid {
+				return jwk.publicKey()
+			}
+		}
+		return nil, ErrInvalidJWT
+	}, &claims)
+	return err
+}
+
+// After a rotation new tokens are signed with the new key, while the old
+// key stays published so that tokens it signed keep verifying.
+func TestSigningKeyRotation(t *testing.T) {
+	server, _ := newTestServer(t, func(config *Config) {
+		config.TokenMode = TokenModeJWT
+		config.AdminToken = "admin-token"
+	})
+	newTestUser(t, server, "alice@example.com")
+	before := logIn(t, server, httptest.NewRequest(http.MethodGet, "/", nil), "alice@example.com").SessionToken
+
+	set := fetchJWKS(t, server)
+	if len(set.Keys) != 1 {
+		t.Fatalf("JWKS has %d keys before rotating, want 1", len(set.Keys))
+	}
+	if err := verifyWithJWKS(set, before); err != nil {
+		t.Fatalf("token does not verify against the JWKS: %v", err)
+	}
+
+	var rotated struct {
+		Kid string `json:"kid"`
+	}
+	for _, tt := range []struct {
+		adminToken string
+		want       int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusForbidden},
+		{"admin-token", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/jwks/rotate", nil)
+		if tt.adminToken != "" {
+			req.Header.Set(adminTokenHeader, tt.adminToken)
+		}
+		rec := httptest.NewRecorder()
+		NewJWKSHandler(server).HandleRotate(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("rotate with admin token %q answered %d, want %d", tt.adminToken, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusOK {
+			json.NewDecoder(rec.Body).Decode(&rotated)
+		}
+	}
+
+	after := logIn(t, server, httptest.NewRequest(http.MethodGet, "/", nil), "alice@example.com").SessionToken
+	set = fetchJWKS(t, server)
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS has %d keys after rotating, want 2", len(set.Keys))
+	}
+	header, _ := parseJWT(after, func(string) (*rsa.PublicKey, error) { return nil, ErrInvalidJWT }, &jwtSessionClaims{})
+	if header.Kid != rotated.Kid {
+		t.Errorf("new token signed with %q, want the new key %q", header.Kid, rotated.Kid)
+	}
+	for name, token := range map[string]string{"old": before, "new": after} {
+		if err := verifyWithJWKS(set, token); err != nil {
+			t.Errorf("%s token does not verify against the JWKS: %v", name, err)
+		}
+		if code := checkAuth(server, token); code != http.StatusOK {
+			t.Errorf("%s token answered %d, want 200", name, code)
+		}
+	}
+}
+
+func TestJWKSOnlyInJWTMode(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	rec := httptest.NewRecorder()
+	NewJWKSHandler(server).HandleJWKS(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("JWKS in session mode answered %d, want 404", rec.Code)
+	}
+}
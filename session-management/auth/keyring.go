@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix marks an encrypted payload. It is followed by the key ID,
+// a colon, and the GCM nonce and ciphertext. Plaintext JSON never starts
+// with it, so both can be told apart while sessions are being migrated.
+const encryptedPrefix = "enc:"
+
+var ErrUnknownKey = errors.New("payload encrypted with unknown key")
+
+// Keyring encrypts payloads with AES-GCM. It holds any number of keys by ID:
+// new payloads are sealed with the primary key, and payloads sealed with any
+// of the others stay readable. Rotating means adding a new primary key,
+// re-encrypting what was stored under the old one, and then removing it.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// ParseKeyring builds a keyring from "id:base64key" entries, the first of
+// which becomes the primary key. Keys must be 16, 24 or 32 bytes long, e.g.
+// from `openssl rand -base64 32`.
+func ParseKeyring(entries []string) (*Keyring, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("keyring needs at least one key")
+	}
+
+	keyring := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	for i, entry := range entries {
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key %d: want id:base64key", i+1)
+		}
+		if _, exists := keyring.aeads[id]; exists {
+			return nil, fmt.Errorf("key %q: duplicate id", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyring.aeads[id] = aead
+		if i == 0 {
+			keyring.primary = id
+		}
+	}
+	return keyring, nil
+}
+
+// Seal encrypts plaintext with the primary key. additionalData is
+// authenticated but not stored; Open must be given the same.
+func (k *Keyring) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := []byte(encryptedPrefix + k.primary + ":")
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts a payload sealed with any key in the keyring.
+func (k *Keyring) Open(sealed, additionalData []byte) ([]byte, error) {
+	id, payload, ok := splitSealed(sealed)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	aead, ok := k.aeads[id]
+	if !ok || len(payload) < aead.NonceSize() {
+		return nil, ErrUnknownKey
+	}
+	nonce, ciphertext := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// IsSealed reports whether data is an encrypted payload.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedPrefix))
+}
+
+// NeedsRotation reports whether data is plaintext or sealed with a key
+// other than the primary one.
+func (k *Keyring) NeedsRotation(data []byte) bool {
+	id, _, ok := splitSealed(data)
+	return !ok || id != k.primary
+}
+
+func splitSealed(data []byte) (string, []byte, bool) {
+	if !IsSealed(data) {
+		return "", nil, false
+	}
+	id, payload, ok := bytes.Cut(data[len(encryptedPrefix):], []byte(":"))
+	return string(id), payload, ok
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func testKey(t *testing.T, id string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func mustParseKeyring(t *testing.T, entries ...string) *Keyring {
+	t.Helper()
+	keyring, err := ParseKeyring(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestParseKeyring(t *testing.T) {
+	k1, k2 := testKey(t, "k1"), testKey(t, "k2")
+	tests := []struct {
+		name    string
+		entries []string
+		ok      bool
+	}{
+		{"one key", []string{k1}, true},
+		{"two keys", []string{k2, k1}, true},
+		{"16-byte key", []string{"k:" + base64.StdEncoding.EncodeToString(make([]byte, 16))}, true},
+		{"no keys", nil, false},
+		{"no id", []string{k1[len("k1"):]}, false},
+		{"no separator", []string{"k1"}, false},
+		{"duplicate id", []string{k1, k1}, false},
+		{"not base64", []string{"k1:***"}, false},
+		{"wrong key size", []string{"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 20))}, false},
+	}
+	for _, tt := range tests {
+		if _, err := ParseKeyring(tt.entries); (err == nil) != tt.ok {
+			t.Errorf("%s: returned %v", tt.name, err)
+		}
+	}
+}
+
+func TestKeyringOpen(t *testing.T) {
+	k1, k2 := testKey(t, "k1"), testKey(t, "k2")
+	old := mustParseKeyring(t, k1)
+	sealed, err := old.Seal([]byte("secret"), []byte("session:abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) {
+		t.Fatalf("sealed payload %q lacks the %q prefix", sealed, encryptedPrefix)
+	}
+
+	tests := []struct {
+		name           string
+		keyring        *Keyring
+		sealed         []byte
+		additionalData string
+		ok             bool
+	}{
+		{"same keyring", old, sealed, "session:abc", true},
+		{"old key kept after rotation", mustParseKeyring(t, k2, k1), sealed, "session:abc", true},
+		{"old key removed", mustParseKeyring(t, k2), sealed, "session:abc", false},
+		{"other additional data", old, sealed, "session:xyz", false},
+		{"tampered", old, append(sealed[:len(sealed)-1:len(sealed)-1], sealed[len(sealed)-1]^1), "session:abc", false},
+		{"truncated", old, []byte(encryptedPrefix + "k1:"), "session:abc", false},
+		{"plaintext", old, []byte("secret"), "session:abc", false},
+	}
+	for _, tt := range tests {
+		plaintext, err := tt.keyring.Open(tt.sealed, []byte(tt.additionalData))
+		if tt.ok && (err != nil || string(plaintext) != "secret") {
+			t.Errorf("%s: opened %q, %v", tt.name, plaintext, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: opened %q", tt.name, plaintext)
+		}
+	}
+	if _, err := mustParseKeyring(t, k2).Open(sealed, []byte("session:abc")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("opening with the key removed returned %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestKeyringNeedsRotation(t *testing.T) {
+	k1, k2 := testKey(t, "k1"), testKey(t, "k2")
+	old := mustParseKeyring(t, k1)
+	rotated := mustParseKeyring(t, k2, k1)
+	underOld, _ := old.Seal([]byte("secret"), nil)
+	underNew, _ := rotated.Seal([]byte("secret"), nil)
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"plaintext", []byte(`{"user_id": "1"}`), true},
+		{"sealed with the old primary", underOld, true},
+		{"sealed with the new primary", underNew, false},
+	}
+	for _, tt := range tests {
+		if got := rotated.NeedsRotation(tt.data); got != tt.want {
+			t.Errorf("%s: NeedsRotation is %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Re-encrypting moves every field of every session to the new primary key,
+// after which the old key can be removed without losing sessions.
+func TestReencryptSessions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	k1, k2 := testKey(t, "k1"), testKey(t, "k2")
+
+	now := time.Now()
+	session := &Session{UserID: "u1", CreatedAt: now, ExpiresAt: now.Add(time.Hour), AbsoluteExpiresAt: now.Add(time.Hour)}
+	old := NewRedisSessionStore(client, mustParseKeyring(t, k1))
+	if err := old.Save(ctx, "abc", session); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SetFields(ctx, "abc", map[string][]byte{"cart": []byte("3 items")}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := NewRedisSessionStore(client, mustParseKeyring(t, k2, k1))
+	if n, err := rotated.Reencrypt(ctx); err != nil || n != 1 {
+		t.Fatalf("first pass rewrote %d sessions, %v; want 1", n, err)
+	}
+	if n, err := rotated.Reencrypt(ctx); err != nil || n != 0 {
+		t.Errorf("second pass rewrote %d sessions, %v; want 0", n, err)
+	}
+
+	retired := NewRedisSessionStore(client, mustParseKeyring(t, k2))
+	got, err := retired.Get(ctx, "abc")
+	if err != nil || got.UserID != "u1" {
+		t.Fatalf("session after removing the old key: %+v, %v", got, err)
+	}
+	if cart, err := retired.GetField(ctx, "abc", "cart"); err != nil || string(cart) != "3 items" {
+		t.Errorf("session data after removing the old key: %q, %v", cart, err)
+	}
+
+	if _, err := NewRedisSessionStore(client, nil).Reencrypt(ctx); err == nil {
+		t.Error("Reencrypt without a keyring succeeded")
+	}
+}
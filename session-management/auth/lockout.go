@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	loginFailuresPrefix = "login_failures:"
+	loginDelayPrefix    = "login_delay:"
+	lockoutPrefix       = "lockout:"
+	lockoutEventsKey    = "lockout_events"
+
+	lockoutScopeEmail = "email"
+	lockoutScopeIP    = "ip"
+
+	maxLoginDelay     = 30 * time.Second
+	maxLockoutEvents  = 1000
+	defaultEventLimit = 50
+)
+
+// LockoutEvent records a lockout being applied or cleared for an email
+// address or client IP.
+type LockoutEvent struct {
+	Scope       string    `json:"scope"`
+	Subject     string    `json:"subject"`
+	Action      string    `json:"action"`
+	Failures    int64     `json:"failures,omitempty"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+type lockoutSubject struct {
+	scope   string
+	subject string
+}
+
+func (l lockoutSubject) key(prefix string) string {
+	return prefix + l.scope + ":" + l.subject
+}
+
+func loginSubjects(email, ip string) []lockoutSubject {
+	return []lockoutSubject{
+		{scope: lockoutScopeEmail, subject: normalizeEmail(email)},
+		{scope: lockoutScopeIP, subject: ip},
+	}
+}
+
+// loginRetryAfter reports how long the caller has to wait before another
+// login attempt for this email and IP is accepted. Zero means go ahead.
+func (s *Server) loginRetryAfter(ctx context.Context, email, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, subject := range loginSubjects(email, ip) {
+		for _, prefix := range []string{lockoutPrefix, loginDelayPrefix} {
+			ttl, err := s.redis.PTTL(ctx, subject.key(prefix)).Result()
+			if err != nil {
+				return 0, err
+			}
+			if ttl > wait {
+				wait = ttl
+			}
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed attempt against both the email and the
+// IP. From the LoginDelayAfter-th failure on, each further attempt has to
+// wait twice as long as the previous one; at LoginMaxFailures the subject is
+// locked out for LockoutDuration.
+func (s *Server) recordLoginFailure(ctx context.Context, email, ip string) error {
+	for _, subject := range loginSubjects(email, ip) {
+		failuresKey := subject.key(loginFailuresPrefix)
+		failures, err := s.redis.Incr(ctx, failuresKey).Result()
+		if err != nil {
+			return err
+		}
+		if failures == 1 {
+			s.redis.Expire(ctx, failuresKey, s.config.LoginFailureWindow)
+		}
+
+		if failures >= int64(s.config.LoginMaxFailures) {
+			if err := s.lockout(ctx, subject, failures); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if failures >= int64(s.config.LoginDelayAfter) {
+			exponent := float64(failures - int64(s.config.LoginDelayAfter))
+			delay := time.Duration(math.Pow(2, exponent)) * time.Second
+			if delay > maxLoginDelay {
+				delay = maxLoginDelay
+			}
+			if err := s.redis.Set(ctx, subject.key(loginDelayPrefix), failures, delay).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) lockout(ctx context.Context, subject lockoutSubject, failures int64) error {
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, subject.key(lockoutPrefix), failures, s.config.LockoutDuration)
+	pipe.Del(ctx, subject.key(loginFailuresPrefix), subject.key(loginDelayPrefix))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	return s.recordLockoutEvent(ctx, LockoutEvent{
+		Scope:       subject.scope,
+		Subject:     subject.subject,
+		Action:      "locked",
+		Failures:    failures,
+		LockedUntil: time.Now().Add(s.config.LockoutDuration),
+		At:          time.Now(),
+	})
+}
+
+// clearLoginFailures forgets the failed attempts for an email after a
+// successful login. The IP counters are left alone since one IP may be
+// guessing passwords for many accounts.
+func (s *Server) clearLoginFailures(ctx context.Context, email string) error {
+	subject := lockoutSubject{scope: lockoutScopeEmail, subject: normalizeEmail(email)}
+	return s.deleteKeys(ctx, subject.key(loginFailuresPrefix), subject.key(loginDelayPrefix))
+}
+
+func (s *Server) recordLockoutEvent(ctx context.Context, event LockoutEvent) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	pipe := s.redis.TxPipeline()
+	pipe.LPush(ctx, lockoutEventsKey, eventJSON)
+	pipe.LTrim(ctx, lockoutEventsKey, 0, maxLockoutEvents-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many login attempts", http.StatusTooManyRequests)
+}
+
+func (s *Server) handleClearLockout(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var clearReq struct {
+		Scope   string `json:"scope"`
+		Subject string `json:"subject"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&clearReq); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if clearReq.Scope == lockoutScopeEmail {
+		clearReq.Subject = normalizeEmail(clearReq.Subject)
+	}
+	if (clearReq.Scope != lockoutScopeEmail && clearReq.Scope != lockoutScopeIP) || clearReq.Subject == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	subject := lockoutSubject{scope: clearReq.Scope, subject: clearReq.Subject}
+	err := s.deleteKeys(r.Context(),
+		subject.key(lockoutPrefix),
+		subject.key(loginFailuresPrefix),
+		subject.key(loginDelayPrefix),
+	)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.recordLockoutEvent(r.Context(), LockoutEvent{
+		Scope:   subject.scope,
+		Subject: subject.subject,
+		Action:  "cleared",
+		At:      time.Now(),
+	})
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Lockout cleared",
+	})
+}
+
+// handleLockoutEvents lists recent lockout events, newest first, optionally
+// filtered by the scope and subject query parameters.
+func (s *Server) handleLockoutEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultEventLimit
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 {
+		limit = value
+	}
+	// The list never holds more than maxLockoutEvents anyway
+	if limit > maxLockoutEvents {
+		limit = maxLockoutEvents
+	}
+
+	entries, err := s.redis.LRange(r.Context(), lockoutEventsKey, 0, -1).Result()
+	if err != nil && err != redis.Nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	events := make([]LockoutEvent, 0, limit)
+	for _, entry := range entries {
+		var event LockoutEvent
+		if err := json.Unmarshal([]byte(entry), &event); err != nil {
+			continue
+		}
+		if scope := query.Get("scope"); scope != "" && event.Scope != scope {
+			continue
+		}
+		if subject := query.Get("subject"); subject != "" && event.Subject != subject {
+			continue
+		}
+		events = append(events, event)
+		if len(events) == limit {
+			break
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"events": events,
+	})
+}
+
+type LockoutHandler struct {
+	server *Server
+}
+
+func NewLockoutHandler(server *Server) *LockoutHandler {
+	return &LockoutHandler{server: server}
+}
+
+func (h *LockoutHandler) HandleClear(w http.ResponseWriter, r *http.Request) {
+	h.server.handleClearLockout(w, r)
+}
+
+func (h *LockoutHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	h.server.handleLockoutEvents(w, r)
+}
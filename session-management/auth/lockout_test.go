@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLockoutTestServer(t *testing.T) *Server {
+	t.Helper()
+	server, _ := newTestServer(t, func(config *Config) {
+		config.LoginDelayAfter = 3
+		config.LoginMaxFailures = 5
+		config.LockoutDuration = 15 * time.Minute
+		config.AdminToken = "admin-token"
+	})
+	return server
+}
+
+// Failures first delay further attempts exponentially, then lock the email
+// and IP out.
+func TestLoginRetryAfter(t *testing.T) {
+	server := newLockoutTestServer(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		if err := server.recordLoginFailure(ctx, "alice@example.com", "203.0.113.5"); err != nil {
+			t.Fatal(err)
+		}
+		wait, err := server.loginRetryAfter(ctx, "Alice@Example.com", "198.51.100.7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != tt.want {
+			t.Errorf("after %d failures the email waits %s, want %s", tt.failures, wait, tt.want)
+		}
+		if wait, _ := server.loginRetryAfter(ctx, "bob@example.com", "203.0.113.5"); wait != tt.want {
+			t.Errorf("after %d failures the IP waits %s, want %s", tt.failures, wait, tt.want)
+		}
+	}
+
+	// A locked-out email is refused even with the right password
+	newTestUser(t, server, "alice@example.com")
+	body := `{"email": "alice@example.com", "password": "` + testPassword + `"}`
+	rec := httptest.NewRecorder()
+	NewLoginHandler(server).HandleLogin(rec, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body)))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "900" {
+		t.Errorf("login while locked out answered %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestLockoutEvents(t *testing.T) {
+	server := newLockoutTestServer(t)
+	for i := 0; i < 5; i++ {
+		server.recordLoginFailure(context.Background(), "alice@example.com", "203.0.113.5")
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 2},
+		{"?scope=ip", 1},
+		{"?subject=alice@example.com", 1},
+		{"?limit=1", 1},
+		{"?limit=2000000000", 2},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/lockouts"+tt.query, nil)
+		req.Header.Set(adminTokenHeader, "admin-token")
+		rec := httptest.NewRecorder()
+		NewLockoutHandler(server).HandleEvents(rec, req)
+		var resp struct {
+			Events []LockoutEvent `json:"events"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("%q answered %d: %v", tt.query, rec.Code, err)
+		}
+		if len(resp.Events) != tt.want {
+			t.Errorf("%q listed %d events, want %d", tt.query, len(resp.Events), tt.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	magicLinkPrefix     = "magic_link:"
+	magicLinkRatePrefix = "magic_link_rate:"
+)
+
+// A magic link token is a random value and its HMAC under
+// config.MagicLinkSecret, so links that were not issued here are turned away
+// without a Redis lookup. Like reset tokens, issued tokens are stored by
+// their SHA-256.
+
+func magicLinkKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return magicLinkPrefix + hex.EncodeToString(sum[:])
+}
+
+func (s *Server) signMagicLinkValue(value string) string {
+	mac := hmac.New(sha256.New, s.magicLinkSecret)
+	mac.Write([]byte(value))
+	return b64.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) newMagicLinkToken() (string, error) {
+	value, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	return value + "." + s.signMagicLinkValue(value), nil
+}
+
+func (s *Server) validMagicLinkToken(token string) bool {
+	value, signature, ok := strings.Cut(token, ".")
+	return ok && hmac.Equal([]byte(signature), []byte(s.signMagicLinkValue(value)))
+}
+
+// magicLinkRetryAfter counts a link request for the email and returns how
+// long to wait if the email has asked for too many links lately.
+func (s *Server) magicLinkRetryAfter(ctx context.Context, email string) (time.Duration, error) {
+	rateKey := magicLinkRatePrefix + normalizeEmail(email)
+	requests, err := s.redis.Incr(ctx, rateKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	if requests == 1 {
+		s.redis.Expire(ctx, rateKey, s.config.MagicLinkRateWindow)
+	}
+	if requests <= int64(s.config.MagicLinkMaxRequests) {
+		return 0, nil
+	}
+
+	return s.redis.PTTL(ctx, rateKey).Result()
+}
+
+func (s *Server) sendMagicLink(ctx context.Context, user *User) error {
+	token, err := s.newMagicLinkToken()
+	if err != nil {
+		return err
+	}
+
+	if err := s.redis.Set(ctx, magicLinkKey(token), user.ID, s.config.MagicLinkTTL).Err(); err != nil {
+		return err
+	}
+
+	link := s.config.PublicURL + "/magic-login?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Open the link below within %s to log in:\r\n%s\r\n\r\n"+
+			"The link works once. If you didn't ask for it, you can ignore this email.",
+			s.config.MagicLinkTTL, link),
+	})
+}
+
+func (s *Server) handleRequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var linkReq struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&linkReq); err != nil || linkReq.Email == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Counted for unknown emails too, so the limit reveals nothing
+	wait, err := s.magicLinkRetryAfter(r.Context(), linkReq.Email)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	user, err := s.getUserByEmail(r.Context(), linkReq.Email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if user != nil {
+		if err := s.sendMagicLink(r.Context(), user); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "If the account exists, a login link has been sent",
+	})
+}
+
+// handleMagicLogin exchanges a magic link token for a session, like a
+// password login would. The token comes from the JSON body or the token
+// query parameter. The emailed link opens frontend/public/magic-login.html,
+// which posts the token here.
+func (s *Server) handleMagicLogin(w http.ResponseWriter, r *http.Request) {
+	var loginReq struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&loginReq); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if loginReq.Token == "" {
+		loginReq.Token = r.URL.Query().Get("token")
+	}
+	if !s.validMagicLinkToken(loginReq.Token) {
+		http.Error(w, "Invalid or expired link", http.StatusUnauthorized)
+		return
+	}
+
+	// GETDEL consumes the token atomically, so it works exactly once
+	userID, err := s.redis.GetDel(r.Context(), magicLinkKey(loginReq.Token)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Invalid or expired link", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := s.getUser(r.Context(), userID)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "Invalid or expired link", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.finishLogin(w, r, user, "magic link")
+}
+
+type MagicLinkHandler struct {
+	server *Server
+}
+
+func NewMagicLinkHandler(server *Server) *MagicLinkHandler {
+	return &MagicLinkHandler{server: server}
+}
+
+func (h *MagicLinkHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	h.server.handleRequestMagicLink(w, r)
+}
+
+func (h *MagicLinkHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	h.server.handleMagicLogin(w, r)
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requestMagicLink(server *Server, email string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	NewMagicLinkHandler(server).HandleRequest(rec, httptest.NewRequest(http.MethodPost, "/api/magic-link", strings.NewReader(`{"email": "`+email+`"}`)))
+	return rec
+}
+
+// lastMagicLinkToken returns the token from the newest mail.
+func lastMagicLinkToken(t *testing.T, mailer *MemoryMailer) string {
+	t.Helper()
+	messages := mailer.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no magic link sent")
+	}
+	match := resetLinkToken.FindStringSubmatch(messages[len(messages)-1].Body)
+	if match == nil {
+		t.Fatalf("no magic link in %q", messages[len(messages)-1].Body)
+	}
+	token, _ := url.QueryUnescape(match[1])
+	return token
+}
+
+// A link logs in once, from the body or the query string, and only while
+// it has not expired.
+func TestMagicLinkLogin(t *testing.T) {
+	mailer := NewMemoryMailer()
+	server, mr := newTestServer(t, func(config *Config) {
+		config.Mailer = mailer
+		config.MagicLinkSecret = "magic-secret"
+		config.MagicLinkTTL = 10 * time.Minute
+	})
+	newTestUser(t, server, "alice@example.com")
+
+	if rec := requestMagicLink(server, "alice@example.com"); rec.Code != http.StatusOK {
+		t.Fatalf("request answered %d", rec.Code)
+	}
+	token := lastMagicLinkToken(t, mailer)
+	value, signature, _ := strings.Cut(token, ".")
+	forged := "0" + value[1:] + "." + signature
+	if forged == token {
+		forged = "1" + value[1:] + "." + signature
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		want   int
+	}{
+		{"no token", "/api/magic-login", "", http.StatusUnauthorized},
+		{"unsigned", "/api/magic-login", `{"token": "` + value + `"}`, http.StatusUnauthorized},
+		{"forged value", "/api/magic-login", `{"token": "` + forged + `"}`, http.StatusUnauthorized},
+		{"valid", "/api/magic-login?token=" + url.QueryEscape(token), "", http.StatusOK},
+		{"replayed", "/api/magic-login", `{"token": "` + token + `"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		NewMagicLinkHandler(server).HandleLogin(rec, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+		if rec.Code != tt.want {
+			t.Errorf("%s: login answered %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusOK && !strings.Contains(rec.Body.String(), `"session_token"`) {
+			t.Errorf("%s: no session token in %s", tt.name, rec.Body)
+		}
+	}
+
+	requestMagicLink(server, "alice@example.com")
+	expired := lastMagicLinkToken(t, mailer)
+	mr.FastForward(11 * time.Minute)
+	rec := httptest.NewRecorder()
+	NewMagicLinkHandler(server).HandleLogin(rec, httptest.NewRequest(http.MethodPost, "/api/magic-login", strings.NewReader(`{"token": "`+expired+`"}`)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired link answered %d, want 401", rec.Code)
+	}
+}
+
+// Requests are limited per email whether or not the account exists, and
+// only existing accounts get mail.
+func TestMagicLinkRateLimit(t *testing.T) {
+	mailer := NewMemoryMailer()
+	server, mr := newTestServer(t, func(config *Config) {
+		config.Mailer = mailer
+		config.MagicLinkSecret = "magic-secret"
+		config.MagicLinkMaxRequests = 2
+		config.MagicLinkRateWindow = 15 * time.Minute
+	})
+	newTestUser(t, server, "alice@example.com")
+
+	tests := []struct {
+		email string
+		want  int
+	}{
+		{"alice@example.com", http.StatusOK},
+		{"Alice@Example.com", http.StatusOK},
+		{"alice@example.com", http.StatusTooManyRequests},
+		{"nobody@example.com", http.StatusOK},
+		{"nobody@example.com", http.StatusOK},
+		{"nobody@example.com", http.StatusTooManyRequests},
+	}
+	for i, tt := range tests {
+		rec := requestMagicLink(server, tt.email)
+		if rec.Code != tt.want {
+			t.Errorf("request %d for %s answered %d, want %d", i+1, tt.email, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d for %s has no Retry-After", i+1, tt.email)
+		}
+	}
+	if sent := len(mailer.Messages()); sent != 2 {
+		t.Errorf("sent %d links, want 2", sent)
+	}
+
+	mr.FastForward(16 * time.Minute)
+	if rec := requestMagicLink(server, "alice@example.com"); rec.Code != http.StatusOK {
+		t.Errorf("request after the window answered %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// SessionCookieName is the cookie RequireSession reads the session token from
+// when the request has no Authorization header.
+const SessionCookieName = "session_token"
+
+type contextKey int
+
+const (
+	sessionContextKey contextKey = iota
+	sessionTokenContextKey
+)
+
+// RequireSession only lets requests with a valid session or API key through
+// to next. State-changing requests authenticated by cookie also need a valid
+// CSRF token. The session is available to next via SessionFromContext.
+func (s *Server) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, session, err := s.authenticatedSession(r)
+		if errors.Is(err, ErrStepUpRequired) {
+			writeStepUpRequired(w)
+			return
+		}
+		if errors.Is(err, ErrSessionNotFound) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if csrfRequired(r) && !validCSRF(r, session.CSRFToken) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), sessionContextKey, session)
+		ctx = context.WithValue(ctx, sessionTokenContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireSessionFunc is RequireSession for plain handler functions.
+func (s *Server) RequireSessionFunc(next http.HandlerFunc) http.Handler {
+	return s.RequireSession(next)
+}
+
+// SessionFromContext returns the session RequireSession stored in ctx.
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionContextKey).(*Session)
+	return session, ok
+}
+
+// userSessionFromContext is SessionFromContext for handlers that act on the
+// user's own account, which API keys cannot do.
+func userSessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := SessionFromContext(ctx)
+	if !ok || session.APIKeyID != "" {
+		return nil, false
+	}
+	return session, true
+}
+
+func sessionTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(sessionTokenContextKey).(string)
+	return token
+}
+
+// tokenFromRequest returns the session token from the Authorization header,
+// falling back to the session cookie, and whether it came from the cookie.
+func tokenFromRequest(r *http.Request) (string, bool) {
+	if token := bearerToken(r); token != "" {
+		return token, false
+	}
+	if cookie, err := r.Cookie(SessionCookieName); err == nil {
+		return cookie.Value, true
+	}
+	return "", false
+}
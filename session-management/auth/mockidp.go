@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const mockIdPCodeTTL = time.Minute
+
+// MockIdP is a tiny in-process OpenID Connect provider for local development
+// and tests. It implements discovery, the authorization-code flow with PKCE
+// (S256 only) and a JWK set, and logs in whoever types an email address.
+// Mount it under the path of its issuer URL, e.g.
+//
+//	http.Handle("/mock-idp/", http.StripPrefix("/mock-idp", idp))
+type MockIdP struct {
+	issuer   string
+	clientID string
+	kid      string
+	key      *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthCode
+}
+
+type mockAuthCode struct {
+	email       string
+	nonce       string
+	redirectURI string
+	challenge   string
+	expiresAt   time.Time
+}
+
+type mockIDTokenClaims struct {
+	registeredClaims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+var mockIdPLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock IdP</title></head>
+<body>
+    <h1>Mock IdP sign in</h1>
+    <form method="get">
+        {{range $name, $values := .}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}" />
+        {{end}}{{end}}<input type="email" name="login_hint" placeholder="Email" required />
+        <button type="submit">Sign in</button>
+    </form>
+</body>
+</html>`))
+
+func NewMockIdP(issuer, clientID string) (*MockIdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockIdP{
+		issuer:   issuer,
+		clientID: clientID,
+		kid:      "mock-idp-1",
+		key:      key,
+		codes:    make(map[string]mockAuthCode),
+	}, nil
+}
+
+func (m *MockIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                m.issuer,
+			"authorization_endpoint":                m.issuer + "/authorize",
+			"token_endpoint":                        m.issuer + "/token",
+			"jwks_uri":                              m.issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	case "/authorize":
+		m.handleAuthorize(w, r)
+	case "/token":
+		m.handleToken(w, r)
+	case "/jwks":
+		writeJSON(w, http.StatusOK, JWKSet{Keys: []JWK{newJWK(m.kid, &m.key.PublicKey)}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockIdP) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != m.clientID ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "Invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	// Without a login hint, ask for the email to sign in as
+	email := query.Get("login_hint")
+	if email == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mockIdPLoginPage.Execute(w, query)
+		return
+	}
+
+	code, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	m.mu.Lock()
+	m.codes[code] = mockAuthCode{
+		email:       email,
+		nonce:       query.Get("nonce"),
+		redirectURI: redirectURI.String(),
+		challenge:   query.Get("code_challenge"),
+		expiresAt:   time.Now().Add(mockIdPCodeTTL),
+	}
+	m.mu.Unlock()
+
+	callback := redirectURI.Query()
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	redirectURI.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *MockIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	// Codes are single use
+	m.mu.Lock()
+	code, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || time.Now().After(code.expiresAt) ||
+		r.PostForm.Get("client_id") != m.clientID ||
+		r.PostForm.Get("redirect_uri") != code.redirectURI ||
+		b64.EncodeToString(verifier[:]) != code.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	subject := sha256.Sum256([]byte(code.email))
+	idToken, err := signJWT(m.key, m.kid, mockIDTokenClaims{
+		registeredClaims: registeredClaims{
+			Issuer:    m.issuer,
+			Subject:   "mock-" + hex.EncodeToString(subject[:8]),
+			Audience:  audience{m.clientID},
+			ExpiresAt: now.Add(5 * time.Minute).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		Nonce:         code.nonce,
+		Email:         code.email,
+		EmailVerified: true,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	accessToken, err := randomHex(16)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	oidcStateCookieName  = "oidc_state"
+	oidcStatePrefix      = "oidc_state:"
+	identityPrefix       = "identity:"
+	userIdentitiesSuffix = ":identities"
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLoginState is what the login request leaves in Redis for the
+// callback: the nonce the ID token must echo and the PKCE verifier.
+type oidcLoginState struct {
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+type oidcIDTokenClaims struct {
+	registeredClaims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// oidcProvider caches the provider's discovery document and signing keys.
+type oidcProvider struct {
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	client    *http.Client
+}
+
+func newOIDCProvider() *oidcProvider {
+	return &oidcProvider{
+		keys:   make(map[string]*rsa.PublicKey),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *oidcProvider) discover(ctx context.Context, issuer string) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", discovery.Issuer, issuer)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// publicKey returns the provider's signing key with the given kid, fetching
+// the JWK set again when the kid is unknown, e.g. after a key rotation.
+func (p *oidcProvider) publicKey(ctx context.Context, jwksURI, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set JWKSet
+	if err := p.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, err
+	}
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[jwk.Kid] = key
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidJWT
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return b64.EncodeToString(sum[:])
+}
+
+func identityKey(issuer, subject string) string {
+	return identityPrefix + issuer + "|" + subject
+}
+
+// handleOIDCLogin sends the browser to the provider's authorization
+// endpoint. State, nonce and the PKCE verifier are kept in Redis until the
+// callback, and the state also goes into a cookie, so that the callback is
+// only accepted from the browser that started the login. Without it, a
+// victim sent to the callback URL of an attacker's login would be logged
+// into the attacker's account.
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.config.OIDCIssuer == "" {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+
+	discovery, err := s.oidc.discover(r.Context(), s.config.OIDCIssuer)
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	var state, nonce, verifier string
+	for _, value := range []*string{&state, &nonce, &verifier} {
+		if *value, err = s.generateToken(); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	stateJSON, _ := json.Marshal(oidcLoginState{Nonce: nonce, CodeVerifier: verifier})
+	if err := s.redis.Set(r.Context(), oidcStatePrefix+state, stateJSON, s.config.OIDCStateTTL).Err(); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	// Lax whatever COOKIE_SAMESITE says: the provider's redirect back is a
+	// cross-site navigation
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(s.config.OIDCStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   s.config.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", s.config.OIDCClientID)
+	query.Set("redirect_uri", s.config.OIDCRedirectURL)
+	query.Set("scope", "openid email")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	if hint := r.URL.Query().Get("login_hint"); hint != "" {
+		query.Set("login_hint", hint)
+	}
+	http.Redirect(w, r, discovery.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// exchangeCode redeems the authorization code at the token endpoint and
+// returns the verified claims of the ID token.
+func (s *Server) exchangeCode(ctx context.Context, discovery *oidcDiscovery, code string, state *oidcLoginState) (*oidcIDTokenClaims, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", s.config.OIDCRedirectURL)
+	form.Set("client_id", s.config.OIDCClientID)
+	form.Set("code_verifier", state.CodeVerifier)
+	if s.config.OIDCClientSecret != "" {
+		form.Set("client_secret", s.config.OIDCClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.oidc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, err
+	}
+
+	var claims oidcIDTokenClaims
+	_, err = parseJWT(tokenResp.IDToken, func(kid string) (*rsa.PublicKey, error) {
+		return s.oidc.publicKey(ctx, discovery.JWKSURI, kid)
+	}, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.validate(s.config.OIDCIssuer, s.config.OIDCClientID, time.Now()); err != nil {
+		return nil, err
+	}
+	if claims.Nonce != state.Nonce || claims.Subject == "" {
+		return nil, ErrInvalidJWT
+	}
+	return &claims, nil
+}
+
+// linkIdentity returns the local user for an external identity. Unknown
+// identities are linked to the user with the same verified email, or to a
+// new user without a usable password.
+func (s *Server) linkIdentity(ctx context.Context, claims *oidcIDTokenClaims) (*User, error) {
+	key := identityKey(claims.Issuer, claims.Subject)
+	userID, err := s.redis.Get(ctx, key).Result()
+	if err == nil {
+		return s.getUser(ctx, userID)
+	}
+	if err != redis.Nil {
+		return nil, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, ErrUserNotFound
+	}
+	user, err := s.getUserByEmail(ctx, claims.Email)
+	if errors.Is(err, ErrUserNotFound) {
+		password, err := s.generateToken()
+		if err != nil {
+			return nil, err
+		}
+		user, err = s.createUser(ctx, claims.Email, password)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.SetNX(ctx, key, user.ID, 0)
+	pipe.SAdd(ctx, userPrefix+user.ID+userIdentitiesSuffix, claims.Issuer+"|"+claims.Subject)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.config.OIDCIssuer == "" {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		http.Error(w, "Login failed: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || query.Get("state") == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/api/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.config.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// The state is consumed here, so a callback can only be completed once
+	stateJSON, err := s.redis.GetDel(r.Context(), oidcStatePrefix+query.Get("state")).Bytes()
+	if err == redis.Nil {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	var state oidcLoginState
+	if err := json.Unmarshal(stateJSON, &state); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	discovery, err := s.oidc.discover(r.Context(), s.config.OIDCIssuer)
+	if err != nil {
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	claims, err := s.exchangeCode(r.Context(), discovery, query.Get("code"), &state)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := s.linkIdentity(r.Context(), claims)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "Identity provider did not supply a verified email", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.finishLogin(w, r, user, "oidc")
+}
+
+type OIDCHandler struct {
+	server *Server
+}
+
+func NewOIDCHandler(server *Server) *OIDCHandler {
+	return &OIDCHandler{server: server}
+}
+
+func (h *OIDCHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	h.server.handleOIDCLogin(w, r)
+}
+
+func (h *OIDCHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	h.server.handleOIDCCallback(w, r)
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newOIDCTestServer starts the auth server and the mock IdP behind one test
+// HTTP server, with miniredis standing in for Redis.
+func newOIDCTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	config := LoadConfig()
+	config.RedisAddr = miniredis.RunT(t).Addr()
+	config.MailDir = t.TempDir()
+	config.CookieSecure = false
+	config.OIDCIssuer = ts.URL + "/mock-idp"
+	config.OIDCRedirectURL = ts.URL + "/api/oidc/callback"
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp, err := NewMockIdP(config.OIDCIssuer, config.OIDCClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oidcHandler := NewOIDCHandler(server)
+	mux.HandleFunc("/api/oidc/login", oidcHandler.HandleLogin)
+	mux.HandleFunc("/api/oidc/callback", oidcHandler.HandleCallback)
+	mux.HandleFunc("/api/check-auth", NewCheckAuthHandler(server).HandleCheckAuth)
+	mux.Handle("/mock-idp/", http.StripPrefix("/mock-idp", idp))
+	return ts
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	ts := newOIDCTestServer(t)
+	browser := newBrowser(t)
+
+	resp, err := browser.Get(ts.URL + "/api/oidc/login?login_hint=" + url.QueryEscape("alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login ended with %s", resp.Status)
+	}
+	var loginResp struct {
+		SessionToken string `json:"session_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil || loginResp.SessionToken == "" {
+		t.Fatalf("no session token in login response: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/check-auth", nil)
+	req.Header.Set("Authorization", "Bearer "+loginResp.SessionToken)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var session Session
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Email != "alice@example.com" {
+		t.Errorf("logged in as %q, want alice@example.com", session.Email)
+	}
+}
+
+// TestOIDCCallbackFromOtherBrowser plays a login CSRF: the attacker starts a
+// login and completes it at the IdP, then gets the victim to open the
+// callback URL. The victim's browser lacks the state cookie, so no session
+// is created.
+func TestOIDCCallbackFromOtherBrowser(t *testing.T) {
+	ts := newOIDCTestServer(t)
+	attacker := newBrowser(t)
+	var callbackURL string
+	attacker.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/api/oidc/callback" {
+			callbackURL = req.URL.String()
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+
+	resp, err := attacker.Get(ts.URL + "/api/oidc/login?login_hint=" + url.QueryEscape("mallory@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if callbackURL == "" {
+		t.Fatal("the IdP did not redirect to the callback")
+	}
+
+	resp, err = newBrowser(t).Get(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback from another browser answered %s, want 400", resp.Status)
+	}
+
+	// The login is still the attacker's to finish
+	resp, err = attacker.Get(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("callback from the starting browser answered %s, want 200", resp.Status)
+	}
+}
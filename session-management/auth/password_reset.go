@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const passwordResetPrefix = "password_reset:"
+
+// Reset tokens are stored by their SHA-256 so a Redis dump does not hand out
+// working reset links.
+func passwordResetKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return passwordResetPrefix + hex.EncodeToString(sum[:])
+}
+
+func (s *Server) sendPasswordReset(ctx context.Context, user *User) error {
+	token, err := s.generateToken()
+	if err != nil {
+		return err
+	}
+
+	if err := s.redis.Set(ctx, passwordResetKey(token), user.ID, s.config.PasswordResetTTL).Err(); err != nil {
+		return err
+	}
+
+	link := s.config.PublicURL + "/reset-password?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for this account.\r\n\r\n"+
+			"Open the link below within %s to choose a new one:\r\n%s\r\n\r\n"+
+			"If it wasn't you, you can ignore this email.", s.config.PasswordResetTTL, link),
+	})
+}
+
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var forgotReq struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&forgotReq); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.getUserByEmail(r.Context(), forgotReq.Email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if user != nil {
+		if err := s.sendPasswordReset(r.Context(), user); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Same answer whether or not the account exists
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "If the account exists, a reset link has been sent",
+	})
+}
+
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var resetReq struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resetReq); err != nil || resetReq.Token == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(resetReq.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	// GETDEL consumes the token atomically, so it works exactly once
+	userID, err := s.redis.GetDel(r.Context(), passwordResetKey(resetReq.Token)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := s.getUser(r.Context(), userID)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.updatePassword(r.Context(), user.ID, resetReq.Password); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Whoever knew the old password may still hold a session
+	revoked, err := s.revokeUserSessions(r.Context(), user.ID, "")
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.clearLoginFailures(r.Context(), user.Email)
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditPasswordChanged,
+		UserID:  user.ID,
+		Actor:   user.ID,
+		Outcome: AuditSuccess,
+		Detail:  fmt.Sprintf("reset link, %d sessions revoked", revoked),
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":          "Password has been reset",
+		"revoked_sessions": revoked,
+	})
+}
+
+type PasswordResetHandler struct {
+	server *Server
+}
+
+func NewPasswordResetHandler(server *Server) *PasswordResetHandler {
+	return &PasswordResetHandler{server: server}
+}
+
+func (h *PasswordResetHandler) HandleForgot(w http.ResponseWriter, r *http.Request) {
+	h.server.handleForgotPassword(w, r)
+}
+
+func (h *PasswordResetHandler) HandleReset(w http.ResponseWriter, r *http.Request) {
+	h.server.handleResetPassword(w, r)
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var resetLinkToken = regexp.MustCompile(`token=(\S+)`)
+
+func TestPasswordReset(t *testing.T) {
+	mailer := NewMemoryMailer()
+	server, _ := newTestServer(t, func(config *Config) { config.Mailer = mailer })
+	newTestUser(t, server, "alice@example.com")
+	oldSession := logIn(t, server, httptest.NewRequest(http.MethodGet, "/", nil), "alice@example.com").SessionToken
+	handler := NewPasswordResetHandler(server)
+
+	// Unknown accounts get the same answer and no mail
+	for _, email := range []string{"nobody@example.com", "alice@example.com"} {
+		rec := httptest.NewRecorder()
+		handler.HandleForgot(rec, httptest.NewRequest(http.MethodPost, "/api/password/forgot", strings.NewReader(`{"email": "`+email+`"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("forgot for %s answered %d", email, rec.Code)
+		}
+	}
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To != "alice@example.com" {
+		t.Fatalf("sent %v, want one message to alice", messages)
+	}
+	match := resetLinkToken.FindStringSubmatch(messages[0].Body)
+	if match == nil {
+		t.Fatalf("no reset link in %q", messages[0].Body)
+	}
+	token, _ := url.QueryUnescape(match[1])
+
+	tests := []struct {
+		name     string
+		token    string
+		password string
+		want     int
+	}{
+		{"unknown token", "nope", "new password", http.StatusBadRequest},
+		{"short password", token, "short", http.StatusBadRequest},
+		{"valid", token, "new password", http.StatusOK},
+		{"token reused", token, "other password", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := `{"token": "` + tt.token + `", "password": "` + tt.password + `"}`
+		rec := httptest.NewRecorder()
+		handler.HandleReset(rec, httptest.NewRequest(http.MethodPost, "/api/password/reset", strings.NewReader(body)))
+		if rec.Code != tt.want {
+			t.Errorf("%s: reset answered %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	if _, err := server.authenticate(context.Background(), "alice@example.com", "new password"); err != nil {
+		t.Errorf("new password rejected: %v", err)
+	}
+	if _, err := server.authenticate(context.Background(), "alice@example.com", testPassword); err == nil {
+		t.Error("old password still accepted")
+	}
+	rec := httptest.NewRecorder()
+	NewCheckAuthHandler(server).HandleCheckAuth(rec, bearerRequest(http.MethodGet, "/api/check-auth", oldSession))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("session from before the reset answered %d, want 401", rec.Code)
+	}
+}
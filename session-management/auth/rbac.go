@@ -0,0 +1,328 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	rolePrefix      = "role:"
+	rolesKey        = "roles"
+	userRolesSuffix = ":roles"
+
+	// AdminPermission grants access to the auth admin endpoints, the same as
+	// the X-Admin-Token header does.
+	AdminPermission = "auth:admin"
+)
+
+// Role is a named set of permissions. Permissions are strings such as
+// "tickets:admin"; "tickets:*" grants every tickets permission and "*"
+// grants everything.
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+func userRolesKey(userID string) string {
+	return userPrefix + userID + userRolesSuffix
+}
+
+// HasPermission reports whether the granted permissions include want,
+// directly or through a wildcard.
+func HasPermission(granted []string, want string) bool {
+	for _, permission := range granted {
+		if permission == "*" || permission == want {
+			return true
+		}
+		if strings.HasSuffix(permission, ":*") && strings.HasPrefix(want, strings.TrimSuffix(permission, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// userPermissions returns the user's roles and the union of their
+// permissions.
+func (s *Server) userPermissions(ctx context.Context, userID string) ([]string, []string, error) {
+	roles, err := s.redis.SMembers(ctx, userRolesKey(userID)).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(roles)
+	if len(roles) == 0 {
+		return roles, []string{}, nil
+	}
+
+	// One SMEMBERS per role rather than SUNION, since the role sets may live
+	// in different cluster slots
+	pipe := s.redis.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(roles))
+	for i, role := range roles {
+		cmds[i] = pipe.SMembers(ctx, rolePrefix+role)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, nil, err
+	}
+	seen := map[string]bool{}
+	permissions := []string{}
+	for _, cmd := range cmds {
+		for _, permission := range cmd.Val() {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return roles, permissions, nil
+}
+
+// reloadUserPermissions updates the roles and permissions held by the user's
+// live sessions after an admin changed them, keeping each session's TTL.
+func (s *Server) reloadUserPermissions(ctx context.Context, userID string) error {
+	roles, permissions, err := s.userPermissions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := s.sessions.UserTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		session, err := s.sessions.Get(ctx, token)
+		if errors.Is(err, ErrSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		session.Roles = roles
+		session.Permissions = permissions
+		if err := s.sessions.Update(ctx, token, session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadRolePermissions pushes a changed role definition into the sessions
+// of every user holding the role.
+func (s *Server) reloadRolePermissions(ctx context.Context, role string) error {
+	userIDs := map[string]bool{}
+	err := s.sessions.Scan(ctx, func(token string, session *Session) bool {
+		for _, held := range session.Roles {
+			if held == role {
+				userIDs[session.UserID] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for userID := range userIDs {
+		if err := s.reloadUserPermissions(ctx, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequirePermission returns middleware that lets a request through only if
+// its session's permissions include permission. Behind RequireSession it
+// checks the session already in the context; otherwise it authenticates the
+// request itself the same way. Either way the session is available via
+// SessionFromContext. Apps outside this process use authclient instead.
+func (s *Server) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		check := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, ok := SessionFromContext(r.Context())
+			if !ok || !HasPermission(session.Permissions, permission) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+		authenticated := s.RequireSession(check)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := SessionFromContext(r.Context()); ok {
+				check.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) handleListRoles(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	names, err := s.redis.SMembers(r.Context(), rolesKey).Result()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(names)
+
+	roles := make([]Role, 0, len(names))
+	for _, name := range names {
+		permissions, err := s.redis.SMembers(r.Context(), rolePrefix+name).Result()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		sort.Strings(permissions)
+		roles = append(roles, Role{Name: name, Permissions: permissions})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"roles": roles,
+	})
+}
+
+// handleSaveRole creates a role or replaces its permissions.
+func (s *Server) handleSaveRole(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var role Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil || role.Name == "" || strings.Contains(role.Name, ":") {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.Del(r.Context(), rolePrefix+role.Name)
+	if len(role.Permissions) > 0 {
+		members := make([]interface{}, len(role.Permissions))
+		for i, permission := range role.Permissions {
+			members[i] = permission
+		}
+		pipe.SAdd(r.Context(), rolePrefix+role.Name, members...)
+	}
+	pipe.SAdd(r.Context(), rolesKey, role.Name)
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.reloadRolePermissions(r.Context(), role.Name); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, role)
+}
+
+func (s *Server) handleGetUserRoles(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if _, err := s.getUser(r.Context(), userID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	roles, permissions, err := s.userPermissions(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id":     userID,
+		"roles":       roles,
+		"permissions": permissions,
+	})
+}
+
+// handleSetUserRoles replaces the user's roles. The user's live sessions pick
+// up the new permissions immediately.
+func (s *Server) handleSetUserRoles(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var assignReq struct {
+		UserID string   `json:"user_id"`
+		Roles  []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&assignReq); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.getUser(r.Context(), assignReq.UserID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	members := make([]interface{}, 0, len(assignReq.Roles))
+	for _, role := range assignReq.Roles {
+		exists, err := s.redis.SIsMember(r.Context(), rolesKey, role).Result()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Unknown role: "+role, http.StatusBadRequest)
+			return
+		}
+		members = append(members, role)
+	}
+
+	userKey := userRolesKey(assignReq.UserID)
+	pipe := s.redis.TxPipeline()
+	pipe.Del(r.Context(), userKey)
+	if len(members) > 0 {
+		pipe.SAdd(r.Context(), userKey, members...)
+	}
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.reloadUserPermissions(r.Context(), assignReq.UserID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Roles updated",
+	})
+}
+
+type RolesHandler struct {
+	server *Server
+}
+
+func NewRolesHandler(server *Server) *RolesHandler {
+	return &RolesHandler{server: server}
+}
+
+func (h *RolesHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	h.server.handleListRoles(w, r)
+}
+
+func (h *RolesHandler) HandleSave(w http.ResponseWriter, r *http.Request) {
+	h.server.handleSaveRole(w, r)
+}
+
+func (h *RolesHandler) HandleGetUserRoles(w http.ResponseWriter, r *http.Request) {
+	h.server.handleGetUserRoles(w, r)
+}
+
+func (h *RolesHandler) HandleSetUserRoles(w http.ResponseWriter, r *http.Request) {
+	h.server.handleSetUserRoles(w, r)
+}
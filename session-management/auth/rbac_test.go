@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		granted []string
+		want    string
+		ok      bool
+	}{
+		{[]string{"tickets:admin"}, "tickets:admin", true},
+		{[]string{"tickets:read"}, "tickets:admin", false},
+		{[]string{"tickets:*"}, "tickets:admin", true},
+		{[]string{"tickets:*"}, "ticketsx:admin", false},
+		{[]string{"*"}, "anything:at:all", true},
+		{nil, "tickets:admin", false},
+	}
+	for _, tt := range tests {
+		if got := HasPermission(tt.granted, tt.want); got != tt.ok {
+			t.Errorf("HasPermission(%v, %q) = %v, want %v", tt.granted, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	ctx := context.Background()
+	admin := newTestUser(t, server, "admin@example.com")
+	newTestUser(t, server, "user@example.com")
+	server.redis.SAdd(ctx, rolePrefix+"support", "tickets:*")
+	server.redis.SAdd(ctx, rolesKey, "support")
+	server.redis.SAdd(ctx, userRolesKey(admin.ID), "support")
+
+	adminToken := logIn(t, server, httptest.NewRequest(http.MethodGet, "/", nil), "admin@example.com").SessionToken
+	userToken := logIn(t, server, httptest.NewRequest(http.MethodGet, "/", nil), "user@example.com").SessionToken
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, found := SessionFromContext(r.Context()); !found {
+			t.Error("no session in the context")
+		}
+	})
+	requireAdmin := server.RequirePermission("tickets:admin")
+	handlers := map[string]http.Handler{
+		"alone":                 requireAdmin(ok),
+		"behind RequireSession": server.RequireSession(requireAdmin(ok)),
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"granted", adminToken, http.StatusOK},
+		{"not granted", userToken, http.StatusForbidden},
+		{"no session", "", http.StatusUnauthorized},
+	}
+	for mount, handler := range handlers {
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodGet, "/tickets/admin", nil)
+			if tt.token != "" {
+				req = bearerRequest(http.MethodGet, "/tickets/admin", tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s, %s: answered %d, want %d", mount, tt.name, rec.Code, tt.want)
+			}
+		}
+	}
+}
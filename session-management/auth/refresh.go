@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	refreshTokenPrefix        = "refresh:"
+	refreshFamilyPrefix       = "refresh_family:"
+	userRefreshFamiliesSuffix = ":refresh_families"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token invalid")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// A refresh family is the chain of refresh tokens that descends from a single
+// login. refresh_family:<id> holds the owner, the one refresh token of the
+// chain that may still be used, the access session it was issued with, and
+// the IP and user agent of the login.
+// Every refresh:<token> keeps a used_at field once it has been rotated, so a
+// replayed token can be told apart from an unknown one. The user's families
+// are listed in user:<id>:refresh_families.
+
+func userRefreshFamiliesKey(userID string) string {
+	return userPrefix + userID + userRefreshFamiliesSuffix
+}
+
+// issueRefreshToken adds a new refresh token to the family and makes it, and
+// the given access session, the family's current ones.
+func (s *Server) issueRefreshToken(ctx context.Context, familyID, sessionToken string, session *Session) (string, error) {
+	refreshToken, err := s.generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	userID := session.UserID
+	familyKey := refreshFamilyPrefix + familyID
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, refreshTokenPrefix+refreshToken,
+		"user_id", userID,
+		"family_id", familyID,
+	)
+	pipe.Expire(ctx, refreshTokenPrefix+refreshToken, s.config.RefreshTokenTTL)
+	pipe.HSet(ctx, familyKey,
+		"user_id", userID,
+		"refresh_token", refreshToken,
+		"session_token", sessionToken,
+		"ip", session.IP,
+		"user_agent", session.UserAgent,
+		"device_label", session.DeviceLabel,
+	)
+	pipe.Expire(ctx, familyKey, s.config.RefreshTokenTTL)
+	pipe.SAdd(ctx, userRefreshFamiliesKey(userID), familyID)
+	pipe.Expire(ctx, userRefreshFamiliesKey(userID), s.config.RefreshTokenTTL)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// rotateRefreshToken consumes a refresh token and returns the family it
+// belongs to. HSETNX on used_at makes sure only one caller can consume a given
+// token; any later attempt is a reuse and revokes the whole family.
+func (s *Server) rotateRefreshToken(ctx context.Context, refreshToken string) (familyID, userID string, err error) {
+	if refreshToken == "" {
+		return "", "", ErrRefreshTokenInvalid
+	}
+
+	tokenKey := refreshTokenPrefix + refreshToken
+	fields, err := s.redis.HGetAll(ctx, tokenKey).Result()
+	if err != nil {
+		return "", "", err
+	}
+	familyID, userID = fields["family_id"], fields["user_id"]
+	if familyID == "" {
+		return "", "", ErrRefreshTokenInvalid
+	}
+
+	first, err := s.redis.HSetNX(ctx, tokenKey, "used_at", time.Now().Unix()).Result()
+	if err != nil {
+		return "", "", err
+	}
+	if !first {
+		log.Printf("Refresh token reuse detected, revoking family %s", familyID)
+		if err := s.revokeRefreshFamily(ctx, familyID); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrRefreshTokenReused
+	}
+
+	current, err := s.redis.HGet(ctx, refreshFamilyPrefix+familyID, "refresh_token").Result()
+	if err == redis.Nil {
+		// The family has already been revoked.
+		return "", "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if current != refreshToken {
+		if err := s.revokeRefreshFamily(ctx, familyID); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrRefreshTokenReused
+	}
+
+	return familyID, userID, nil
+}
+
+// restoreFamilyOrigin gives a session issued by refresh the IP, user agent
+// and device label of the family's login, so anomaly checks compare requests
+// with where the user logged in rather than where the refresh token was
+// used. Families from before these were recorded keep the refresher's.
+func (s *Server) restoreFamilyOrigin(ctx context.Context, familyID string, session *Session) error {
+	origin, err := s.redis.HMGet(ctx, refreshFamilyPrefix+familyID, "ip", "user_agent", "device_label").Result()
+	if err != nil {
+		return err
+	}
+	ip, _ := origin[0].(string)
+	if ip == "" {
+		return nil
+	}
+	session.IP = ip
+	session.UserAgent, _ = origin[1].(string)
+	session.DeviceLabel, _ = origin[2].(string)
+	return nil
+}
+
+// revokeRefreshFamily deletes the family's current refresh token and access
+// session, and the family itself, so no token of the chain is usable anymore.
+func (s *Server) revokeRefreshFamily(ctx context.Context, familyID string) error {
+	familyKey := refreshFamilyPrefix + familyID
+	fields, err := s.redis.HGetAll(ctx, familyKey).Result()
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if fields["session_token"] != "" {
+		if err := s.endSession(ctx, fields["session_token"], fields["user_id"]); err != nil {
+			return err
+		}
+	}
+	s.redis.SRem(ctx, userRefreshFamiliesKey(fields["user_id"]), familyID)
+	return s.deleteKeys(ctx, refreshTokenPrefix+fields["refresh_token"], familyKey)
+}
+
+// revokeRefreshFamilies revokes every refresh family of the user except the
+// one of keepToken and returns how many it revoked. In JWT mode this is how
+// all of a user's sessions are revoked: there is no index of issued tokens,
+// but every token is the current one of a family, and revoking the family
+// denylists it.
+func (s *Server) revokeRefreshFamilies(ctx context.Context, userID, keepToken string) (int, error) {
+	familyIDs, err := s.redis.SMembers(ctx, userRefreshFamiliesKey(userID)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, familyID := range familyIDs {
+		token, err := s.redis.HGet(ctx, refreshFamilyPrefix+familyID, "session_token").Result()
+		if err == redis.Nil {
+			s.redis.SRem(ctx, userRefreshFamiliesKey(userID), familyID)
+			continue
+		}
+		if err != nil {
+			return revoked, err
+		}
+		if token == keepToken {
+			continue
+		}
+		if err := s.revokeRefreshFamily(ctx, familyID); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	var refreshReq RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&refreshReq); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if refreshReq.RefreshToken == "" {
+		// Cookie mode: the refresh token comes from its HttpOnly cookie, so
+		// the request has to prove it is not cross-site.
+		if cookie, err := r.Cookie(RefreshCookieName); err == nil {
+			if !validCSRF(r, "") {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			refreshReq.RefreshToken = cookie.Value
+		}
+	}
+
+	familyID, userID, err := s.rotateRefreshToken(r.Context(), refreshReq.RefreshToken)
+	if errors.Is(err, ErrRefreshTokenInvalid) || errors.Is(err, ErrRefreshTokenReused) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := s.getUser(r.Context(), userID)
+	if errors.Is(err, ErrUserNotFound) {
+		s.revokeRefreshFamily(r.Context(), familyID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The access session issued with the previous refresh token is replaced
+	// by the new one.
+	previous, err := s.redis.HGet(r.Context(), refreshFamilyPrefix+familyID, "session_token").Result()
+	if err == nil && previous != "" {
+		s.endSession(r.Context(), previous, userID)
+	}
+
+	s.completeLogin(w, r, user, familyID)
+}
+
+type RefreshHandler struct {
+	server *Server
+}
+
+func NewRefreshHandler(server *Server) *RefreshHandler {
+	return &RefreshHandler{server: server}
+}
+
+func (h *RefreshHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	h.server.handleRefresh(w, r)
+}
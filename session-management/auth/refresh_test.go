@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func refresh(t *testing.T, server *Server, refreshToken string) (testLogin, int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/refresh", strings.NewReader(`{"refresh_token": "`+refreshToken+`"}`))
+	rec := httptest.NewRecorder()
+	NewRefreshHandler(server).HandleRefresh(rec, req)
+	var resp testLogin
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, rec.Code
+}
+
+func checkAuth(server *Server, token string) int {
+	rec := httptest.NewRecorder()
+	NewCheckAuthHandler(server).HandleCheckAuth(rec, bearerRequest(http.MethodGet, "/api/check-auth", token))
+	return rec.Code
+}
+
+// Replaying a rotated refresh token revokes the whole family: the newer
+// refresh token and the access token issued with it stop working too.
+func TestRefreshTokenReuse(t *testing.T) {
+	for _, mode := range []string{TokenModeSession, TokenModeJWT} {
+		server, _ := newTestServer(t, func(config *Config) { config.TokenMode = mode })
+		newTestUser(t, server, "alice@example.com")
+		login := logIn(t, server, httptest.NewRequest(http.MethodGet, "/", nil), "alice@example.com")
+
+		rotated, code := refresh(t, server, login.RefreshToken)
+		if code != http.StatusOK {
+			t.Fatalf("%s: refresh answered %d", mode, code)
+		}
+		if code := checkAuth(server, login.SessionToken); code != http.StatusUnauthorized {
+			t.Errorf("%s: replaced access token answered %d, want 401", mode, code)
+		}
+		if code := checkAuth(server, rotated.SessionToken); code != http.StatusOK {
+			t.Errorf("%s: new access token answered %d, want 200", mode, code)
+		}
+
+		steps := []struct {
+			name  string
+			check func() int
+			want  int
+		}{
+			{"replay of the rotated token", func() int { _, code := refresh(t, server, login.RefreshToken); return code }, http.StatusUnauthorized},
+			{"current refresh token", func() int { _, code := refresh(t, server, rotated.RefreshToken); return code }, http.StatusUnauthorized},
+			{"current access token", func() int { return checkAuth(server, rotated.SessionToken) }, http.StatusUnauthorized},
+			{"unknown refresh token", func() int { _, code := refresh(t, server, "nope"); return code }, http.StatusUnauthorized},
+		}
+		for _, step := range steps {
+			if code := step.check(); code != step.want {
+				t.Errorf("%s: %s answered %d, want %d", mode, step.name, code, step.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxSessionFieldName  = 64
+	maxSessionFieldValue = 16 << 10
+)
+
+// SessionData reads and writes the data bag of one session, such as a cart
+// or the chosen locale. Values are stored as JSON, one field each, so
+// setting a field never overwrites the others.
+type SessionData struct {
+	store SessionStore
+	token string
+}
+
+func NewSessionData(store SessionStore, token string) *SessionData {
+	return &SessionData{store: store, token: token}
+}
+
+// SessionData returns the data bag of the session RequireSession
+// authenticated the request with. JWTs and API keys have no stored session
+// and therefore no data bag.
+func (s *Server) SessionData(r *http.Request) (*SessionData, bool) {
+	token := sessionTokenFromContext(r.Context())
+	if token == "" || isJWT(token) || isAPIKey(token) {
+		return nil, false
+	}
+	return NewSessionData(s.sessions, token), true
+}
+
+// Get decodes the field into v. It returns ErrSessionFieldNotFound if the
+// field is not set.
+func (d *SessionData) Get(ctx context.Context, name string, v interface{}) error {
+	value, err := d.store.GetField(ctx, d.token, name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
+
+func (d *SessionData) Set(ctx context.Context, name string, v interface{}) error {
+	return d.SetMany(ctx, map[string]interface{}{name: v})
+}
+
+// SetMany sets several fields at once.
+func (d *SessionData) SetMany(ctx context.Context, values map[string]interface{}) error {
+	fields := make(map[string][]byte, len(values))
+	for name, v := range values {
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fields[name] = value
+	}
+	return d.store.SetFields(ctx, d.token, fields)
+}
+
+func (d *SessionData) Delete(ctx context.Context, names ...string) error {
+	return d.store.DeleteFields(ctx, d.token, names...)
+}
+
+// All returns every field, still JSON encoded.
+func (d *SessionData) All(ctx context.Context) (map[string]json.RawMessage, error) {
+	data, err := d.store.Data(ctx, d.token)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]json.RawMessage, len(data))
+	for name, value := range data {
+		values[name] = value
+	}
+	return values, nil
+}
+
+func (d *SessionData) String(ctx context.Context, name string) (string, error) {
+	var value string
+	err := d.Get(ctx, name, &value)
+	return value, err
+}
+
+func (d *SessionData) Int(ctx context.Context, name string) (int64, error) {
+	var value int64
+	err := d.Get(ctx, name, &value)
+	return value, err
+}
+
+func (d *SessionData) Bool(ctx context.Context, name string) (bool, error) {
+	var value bool
+	err := d.Get(ctx, name, &value)
+	return value, err
+}
+
+func (d *SessionData) Time(ctx context.Context, name string) (time.Time, error) {
+	var value time.Time
+	err := d.Get(ctx, name, &value)
+	return value, err
+}
+
+func validSessionFieldName(name string) bool {
+	return name != "" && len(name) <= maxSessionFieldName && !strings.ContainsAny(name, " \t\r\n")
+}
+
+// handleGetSessionData returns the field named by the key query parameter,
+// or all fields without one.
+func (s *Server) handleGetSessionData(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.SessionData(r)
+	if !ok {
+		http.Error(w, "Session data requires a session token", http.StatusBadRequest)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		values, err := data.All(r.Context())
+		if errors.Is(err, ErrSessionNotFound) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"data": values,
+		})
+		return
+	}
+
+	var value json.RawMessage
+	err := data.Get(r.Context(), key, &value)
+	if errors.Is(err, ErrSessionFieldNotFound) {
+		http.Error(w, "Field not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrSessionNotFound) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":   key,
+		"value": value,
+	})
+}
+
+// handleSetSessionData sets the fields of the JSON object in the request
+// body. Fields not mentioned keep their values.
+func (s *Server) handleSetSessionData(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.SessionData(r)
+	if !ok {
+		http.Error(w, "Session data requires a session token", http.StatusBadRequest)
+		return
+	}
+
+	var setReq struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&setReq); err != nil || len(setReq.Data) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	values := make(map[string]interface{}, len(setReq.Data))
+	for name, value := range setReq.Data {
+		if !validSessionFieldName(name) || len(value) > maxSessionFieldValue {
+			http.Error(w, "Invalid field: "+name, http.StatusBadRequest)
+			return
+		}
+		values[name] = value
+	}
+
+	err := data.SetMany(r.Context(), values)
+	if errors.Is(err, ErrSessionNotFound) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Session data saved",
+	})
+}
+
+func (s *Server) handleDeleteSessionData(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.SessionData(r)
+	if !ok {
+		http.Error(w, "Session data requires a session token", http.StatusBadRequest)
+		return
+	}
+
+	var deleteReq struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&deleteReq); err != nil || len(deleteReq.Keys) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.Delete(r.Context(), deleteReq.Keys...); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Session data deleted",
+	})
+}
+
+// SessionDataHandler serves the data bag of the caller's session. Its
+// handlers expect to be mounted behind RequireSession.
+type SessionDataHandler struct {
+	server *Server
+}
+
+func NewSessionDataHandler(server *Server) *SessionDataHandler {
+	return &SessionDataHandler{server: server}
+}
+
+func (h *SessionDataHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	h.server.handleGetSessionData(w, r)
+}
+
+func (h *SessionDataHandler) HandleSet(w http.ResponseWriter, r *http.Request) {
+	h.server.handleSetSessionData(w, r)
+}
+
+func (h *SessionDataHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	h.server.handleDeleteSessionData(w, r)
+}
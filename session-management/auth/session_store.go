@@ -0,0 +1,653 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// SessionStore keeps sessions by token together with a per-user index of
+// the tokens, so that all of a user's sessions can be listed and revoked.
+type SessionStore interface {
+	// Save stores the session under its token until session.ExpiresAt and
+	// adds the token to the owner's index, ordered by creation time.
+	Save(ctx context.Context, token string, session *Session) error
+	// Get returns ErrSessionNotFound for unknown and expired tokens.
+	Get(ctx context.Context, token string) (*Session, error)
+	// Update rewrites a stored session without changing its expiry.
+	Update(ctx context.Context, token string, session *Session) error
+	// Touch records that the session was used at lastSeenAt and moves its
+	// expiry to expiresAt, leaving the rest of the session alone. A session
+	// that no longer exists is not brought back.
+	Touch(ctx context.Context, token string, lastSeenAt, expiresAt time.Time) error
+	Delete(ctx context.Context, token, userID string) error
+	// UserTokens returns the tokens of the user's live sessions, oldest
+	// first.
+	UserTokens(ctx context.Context, userID string) ([]string, error)
+	// Scan calls fn for every live session until fn returns false.
+	Scan(ctx context.Context, fn func(token string, session *Session) bool) error
+	// EnforceLimit is called right after token was saved. If the user now
+	// has more sessions than limit allows, it either takes token back out of
+	// the index and returns ErrSessionLimitReached, or removes the oldest
+	// other tokens from the index and returns them for the caller to revoke.
+	EnforceLimit(ctx context.Context, userID, token string, limit SessionLimit) ([]string, error)
+
+	// Data returns the fields of the session's data bag, or
+	// ErrSessionNotFound if the session does not exist.
+	Data(ctx context.Context, token string) (map[string][]byte, error)
+	// GetField returns one data field, or ErrSessionFieldNotFound if it is
+	// not set.
+	GetField(ctx context.Context, token, name string) ([]byte, error)
+	// SetFields writes the given data fields and leaves all others alone, so
+	// requests setting different fields at the same time do not overwrite
+	// each other. It does not change the session's expiry.
+	SetFields(ctx context.Context, token string, fields map[string][]byte) error
+	DeleteFields(ctx context.Context, token string, names ...string) error
+}
+
+var ErrSessionFieldNotFound = errors.New("session field not found")
+
+// SessionLimit caps how many sessions a user may hold at once. Max <= 0
+// means no cap. Without EvictOldest, logins beyond the cap are rejected.
+type SessionLimit struct {
+	Max         int
+	EvictOldest bool
+}
+
+var ErrSessionLimitReached = errors.New("session limit reached")
+
+// Values for Config.SessionLimitPolicy
+const (
+	SessionLimitReject      = "reject"
+	SessionLimitEvictOldest = "evict_oldest"
+)
+
+// A session lives in the hash session:<token>: the session itself is JSON in
+// the session field, when it was last used and when it expires are JSON in
+// the activity field, and every data field is stored under data:<name>.
+// Sessions written before data fields existed are plain JSON strings; they
+// are converted to hashes the first time they are used, or all at once by
+// Migrate.
+const (
+	sessionField    = "session"
+	activityField   = "activity"
+	dataFieldPrefix = "data:"
+)
+
+// sessionActivity is what Touch writes, so that marking a session as seen
+// never rewrites the session itself.
+type sessionActivity struct {
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// RedisSessionStore keeps sessions in hashes as described above and indexes
+// a user's tokens in the sorted set user:<id>:sessions. With a keyring,
+// every field is encrypted; plaintext fields written before the keyring was
+// configured stay readable until they are re-encrypted.
+type RedisSessionStore struct {
+	client  redis.UniversalClient
+	keyring *Keyring
+}
+
+// NewRedisSessionStore returns a store that encrypts sessions with keyring,
+// or stores them as plain JSON if keyring is nil.
+func NewRedisSessionStore(client *redis.Client, keyring *Keyring) *RedisSessionStore {
+	return &RedisSessionStore{client: client, keyring: keyring}
+}
+
+// fieldAdditionalData binds a field's ciphertext to the session and field,
+// so it cannot be copied elsewhere. The session field uses what the whole
+// value used before sessions became hashes, so migrating needs no
+// re-encryption.
+func fieldAdditionalData(token, field string) []byte {
+	if field == sessionField {
+		return []byte(sessionPrefix + token)
+	}
+	return []byte(sessionPrefix + token + "#" + field)
+}
+
+func (st *RedisSessionStore) seal(token, field string, plaintext []byte) ([]byte, error) {
+	if st.keyring == nil {
+		return plaintext, nil
+	}
+	return st.keyring.Seal(plaintext, fieldAdditionalData(token, field))
+}
+
+func (st *RedisSessionStore) open(token, field string, data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	if st.keyring == nil {
+		return nil, ErrUnknownKey
+	}
+	return st.keyring.Open(data, fieldAdditionalData(token, field))
+}
+
+func (st *RedisSessionStore) encode(token string, session *Session) ([]byte, error) {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	return st.seal(token, sessionField, sessionJSON)
+}
+
+func (st *RedisSessionStore) decode(token string, data []byte) (*Session, error) {
+	data, err := st.open(token, sessionField, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// migrateSession turns a session stored as a JSON string into a hash. The
+// value moves to the session field as it is, sealed or not, and keeps its
+// TTL.
+var migrateSession = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= "string" then
+	return 0
+end
+local value = redis.call("GET", KEYS[1])
+local ttl = redis.call("PTTL", KEYS[1])
+redis.call("DEL", KEYS[1])
+redis.call("HSET", KEYS[1], ARGV[1], value)
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1
+`)
+
+// migrated runs op and, if it failed because the session is still stored as
+// a string, migrates the session and runs op again.
+func (st *RedisSessionStore) migrated(ctx context.Context, token string, op func() error) error {
+	err := op()
+	if err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return err
+	}
+	if err := migrateSession.Run(ctx, st.client, []string{sessionPrefix + token}, sessionField).Err(); err != nil {
+		return err
+	}
+	return op()
+}
+
+// hsetIfExists sets hash fields without creating the hash, so a write racing
+// with a logout cannot bring the session back without an expiry.
+var hsetIfExists = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+return redis.call("HSET", KEYS[1], unpack(ARGV))
+`)
+
+// indexSession adds a token to a user's index and extends the index's TTL
+// to cover the session, but never shortens it: a short-lived session, say
+// an impersonation, must not expire the index under the user's other
+// sessions.
+var indexSession = redis.NewScript(`
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl < tonumber(ARGV[3]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+func (st *RedisSessionStore) Save(ctx context.Context, token string, session *Session) error {
+	sessionJSON, err := st.encode(token, session)
+	if err != nil {
+		return err
+	}
+
+	// Only the session field is written, data fields are left as they are.
+	// The index lives as long as the longest-lived session in it may.
+	indexKey := userSessionsKey(session.UserID)
+	return st.migrated(ctx, token, func() error {
+		pipe := st.client.TxPipeline()
+		pipe.HSet(ctx, sessionPrefix+token, sessionField, sessionJSON)
+		pipe.ExpireAt(ctx, sessionPrefix+token, session.ExpiresAt)
+		indexSession.Eval(ctx, pipe, []string{indexKey},
+			session.CreatedAt.Unix(), token, time.Until(session.AbsoluteExpiresAt).Milliseconds())
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+func (st *RedisSessionStore) Get(ctx context.Context, token string) (*Session, error) {
+	if token == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	var values []interface{}
+	err := st.migrated(ctx, token, func() error {
+		var err error
+		values, err = st.client.HMGet(ctx, sessionPrefix+token, sessionField, activityField).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sessionData, ok := values[0].(string)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	session, err := st.decode(token, []byte(sessionData))
+	if err != nil {
+		// Sessions under a retired key or tampered with are as good as gone
+		return nil, ErrSessionNotFound
+	}
+	if activityData, ok := values[1].(string); ok {
+		activityJSON, err := st.open(token, activityField, []byte(activityData))
+		if err != nil {
+			return nil, ErrSessionNotFound
+		}
+		var activity sessionActivity
+		if err := json.Unmarshal(activityJSON, &activity); err != nil {
+			return nil, err
+		}
+		session.LastSeenAt = activity.LastSeenAt
+		session.ExpiresAt = activity.ExpiresAt
+	}
+	return session, nil
+}
+
+func (st *RedisSessionStore) Update(ctx context.Context, token string, session *Session) error {
+	sessionJSON, err := st.encode(token, session)
+	if err != nil {
+		return err
+	}
+	err = st.migrated(ctx, token, func() error {
+		return hsetIfExists.Run(ctx, st.client, []string{sessionPrefix + token}, sessionField, sessionJSON).Err()
+	})
+	if err == redis.Nil {
+		// The session is gone; there is nothing to update
+		return nil
+	}
+	return err
+}
+
+// touchIfExists writes the activity field and the new expiry of a session
+// that still exists.
+var touchIfExists = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return redis.call("PEXPIREAT", KEYS[1], ARGV[3])
+`)
+
+func (st *RedisSessionStore) Touch(ctx context.Context, token string, lastSeenAt, expiresAt time.Time) error {
+	activityJSON, err := json.Marshal(sessionActivity{LastSeenAt: lastSeenAt, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	sealed, err := st.seal(token, activityField, activityJSON)
+	if err != nil {
+		return err
+	}
+	err = st.migrated(ctx, token, func() error {
+		return touchIfExists.Run(ctx, st.client, []string{sessionPrefix + token}, activityField, sealed, expiresAt.UnixMilli()).Err()
+	})
+	if err == redis.Nil {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+func (st *RedisSessionStore) Data(ctx context.Context, token string) (map[string][]byte, error) {
+	var fields map[string]string
+	err := st.migrated(ctx, token, func() error {
+		var err error
+		fields, err = st.client.HGetAll(ctx, sessionPrefix+token).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	data := make(map[string][]byte, len(fields)-1)
+	for field, value := range fields {
+		name, ok := strings.CutPrefix(field, dataFieldPrefix)
+		if !ok {
+			continue
+		}
+		plaintext, err := st.open(token, field, []byte(value))
+		if err != nil {
+			// Like sessions, fields under a retired key are gone
+			continue
+		}
+		data[name] = plaintext
+	}
+	return data, nil
+}
+
+func (st *RedisSessionStore) GetField(ctx context.Context, token, name string) ([]byte, error) {
+	field := dataFieldPrefix + name
+	var values []interface{}
+	err := st.migrated(ctx, token, func() error {
+		var err error
+		values, err = st.client.HMGet(ctx, sessionPrefix+token, sessionField, field).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if values[0] == nil {
+		return nil, ErrSessionNotFound
+	}
+	value, ok := values[1].(string)
+	if !ok {
+		return nil, ErrSessionFieldNotFound
+	}
+
+	plaintext, err := st.open(token, field, []byte(value))
+	if err != nil {
+		return nil, ErrSessionFieldNotFound
+	}
+	return plaintext, nil
+}
+
+func (st *RedisSessionStore) SetFields(ctx context.Context, token string, fields map[string][]byte) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 2*len(fields))
+	for name, value := range fields {
+		field := dataFieldPrefix + name
+		sealed, err := st.seal(token, field, value)
+		if err != nil {
+			return err
+		}
+		args = append(args, field, sealed)
+	}
+
+	err := st.migrated(ctx, token, func() error {
+		return hsetIfExists.Run(ctx, st.client, []string{sessionPrefix + token}, args...).Err()
+	})
+	if err == redis.Nil {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+func (st *RedisSessionStore) DeleteFields(ctx context.Context, token string, names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	fields := make([]string, len(names))
+	for i, name := range names {
+		fields[i] = dataFieldPrefix + name
+	}
+	return st.migrated(ctx, token, func() error {
+		return st.client.HDel(ctx, sessionPrefix+token, fields...).Err()
+	})
+}
+
+func (st *RedisSessionStore) Delete(ctx context.Context, token, userID string) error {
+	pipe := st.client.TxPipeline()
+	pipe.Del(ctx, sessionPrefix+token)
+	pipe.ZRem(ctx, userSessionsKey(userID), token)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// UserTokens prunes index entries whose session has already expired.
+func (st *RedisSessionStore) UserTokens(ctx context.Context, userID string) ([]string, error) {
+	indexKey := userSessionsKey(userID)
+	tokens, err := st.client.ZRange(ctx, indexKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	live := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		exists, err := st.client.Exists(ctx, sessionPrefix+token).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists == 0 {
+			st.client.ZRem(ctx, indexKey, token)
+			continue
+		}
+		live = append(live, token)
+	}
+	return live, nil
+}
+
+func (st *RedisSessionStore) Scan(ctx context.Context, fn func(token string, session *Session) bool) error {
+	_, err := st.scanNode(ctx, st.client, fn)
+	return err
+}
+
+// scanNode walks the session keys of one Redis node with SCAN. It reports
+// whether fn asked to stop.
+func (st *RedisSessionStore) scanNode(ctx context.Context, node redis.Cmdable, fn func(token string, session *Session) bool) (bool, error) {
+	iter := node.Scan(ctx, 0, sessionPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		token := strings.TrimPrefix(iter.Val(), sessionPrefix)
+		session, err := st.Get(ctx, token)
+		if errors.Is(err, ErrSessionNotFound) {
+			// Expired between SCAN and GET
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if !fn(token, session) {
+			return true, nil
+		}
+	}
+	return false, iter.Err()
+}
+
+// ClusterSessionStore is the RedisSessionStore for Redis Cluster. A session
+// and its user's index usually hash to different slots, so Save and Delete
+// are applied per slot rather than in one transaction, and Scan has to visit
+// every master.
+type ClusterSessionStore struct {
+	*RedisSessionStore
+	cluster *redis.ClusterClient
+}
+
+func NewClusterSessionStore(client *redis.ClusterClient, keyring *Keyring) *ClusterSessionStore {
+	return &ClusterSessionStore{
+		RedisSessionStore: &RedisSessionStore{client: client, keyring: keyring},
+		cluster:           client,
+	}
+}
+
+var errScanStopped = errors.New("scan stopped")
+
+func (st *ClusterSessionStore) Scan(ctx context.Context, fn func(token string, session *Session) bool) error {
+	// The masters are scanned concurrently; fn sees one session at a time
+	var mu sync.Mutex
+	stopped := false
+	err := st.cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		stop, err := st.scanNode(ctx, node, func(token string, session *Session) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if stopped {
+				return false
+			}
+			stopped = !fn(token, session)
+			return !stopped
+		})
+		if err != nil {
+			return err
+		}
+		if stop {
+			return errScanStopped
+		}
+		return nil
+	})
+	if errors.Is(err, errScanStopped) {
+		return nil
+	}
+	return err
+}
+
+// enforceSessionLimit runs over the user's session index only, so it works
+// on Redis Cluster too; the caller deletes evicted sessions. Since it runs
+// after the new token was added, concurrent logins are all counted and
+// cannot push the user past the cap together.
+var enforceSessionLimit = redis.NewScript(`
+local max = tonumber(ARGV[2])
+local count = redis.call("ZCARD", KEYS[1])
+if count <= max then
+	return {}
+end
+if ARGV[3] ~= "evict" then
+	redis.call("ZREM", KEYS[1], ARGV[1])
+	return false
+end
+
+local evicted = {}
+for _, token in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	if #evicted == count - max then
+		break
+	end
+	if token ~= ARGV[1] then
+		table.insert(evicted, token)
+	end
+end
+redis.call("ZREM", KEYS[1], unpack(evicted))
+return evicted
+`)
+
+// EnforceLimit first prunes expired sessions from the index so that they do
+// not count against the limit.
+func (st *RedisSessionStore) EnforceLimit(ctx context.Context, userID, token string, limit SessionLimit) ([]string, error) {
+	if limit.Max <= 0 {
+		return nil, nil
+	}
+	if _, err := st.UserTokens(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	policy := "reject"
+	if limit.EvictOldest {
+		policy = "evict"
+	}
+	evicted, err := enforceSessionLimit.Run(ctx, st.client, []string{userSessionsKey(userID)}, token, limit.Max, policy).StringSlice()
+	if err == redis.Nil {
+		return nil, ErrSessionLimitReached
+	}
+	return evicted, err
+}
+
+// replaceFieldIfUnchanged swaps in a new value for a hash field unless the
+// field was written to since old was read.
+var replaceFieldIfUnchanged = redis.NewScript(`
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+end
+return false
+`)
+
+// Reencrypt rewrites every session with a field that is plaintext or
+// encrypted with a key other than the keyring's primary one, and returns how
+// many sessions it rewrote. Fields written in the meantime are skipped;
+// writing them already re-encrypted them.
+func (st *RedisSessionStore) Reencrypt(ctx context.Context) (int, error) {
+	return st.reencrypt(ctx, st.Scan)
+}
+
+func (st *ClusterSessionStore) Reencrypt(ctx context.Context) (int, error) {
+	return st.reencrypt(ctx, st.Scan)
+}
+
+func (st *RedisSessionStore) reencrypt(ctx context.Context, scan func(context.Context, func(string, *Session) bool) error) (int, error) {
+	if st.keyring == nil {
+		return 0, errors.New("no keyring configured")
+	}
+
+	rewritten := 0
+	var rewriteErr error
+	err := scan(ctx, func(token string, _ *Session) bool {
+		key := sessionPrefix + token
+		fields, err := st.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			rewriteErr = err
+			return false
+		}
+
+		rotated := false
+		for field, old := range fields {
+			if !st.keyring.NeedsRotation([]byte(old)) {
+				continue
+			}
+			plaintext, err := st.open(token, field, []byte(old))
+			if err != nil {
+				// Under a retired key; nothing can read it anymore
+				continue
+			}
+			sealed, err := st.seal(token, field, plaintext)
+			if err != nil {
+				rewriteErr = err
+				return false
+			}
+			err = replaceFieldIfUnchanged.Run(ctx, st.client, []string{key}, field, old, sealed).Err()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				rewriteErr = err
+				return false
+			}
+			rotated = true
+		}
+		if rotated {
+			rewritten++
+		}
+		return true
+	})
+	if err != nil {
+		return rewritten, err
+	}
+	return rewritten, rewriteErr
+}
+
+// Migrate converts every session still stored as a JSON string into a hash
+// and returns how many it converted. Sessions are converted as they are used
+// anyway; Migrate gets the ones that are not used before their expiry out of
+// the way too.
+func (st *RedisSessionStore) Migrate(ctx context.Context) (int, error) {
+	return st.migrateNode(ctx, st.client)
+}
+
+func (st *ClusterSessionStore) Migrate(ctx context.Context) (int, error) {
+	var migrated atomic.Int64
+	err := st.cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		converted, err := st.migrateNode(ctx, node)
+		migrated.Add(int64(converted))
+		return err
+	})
+	return int(migrated.Load()), err
+}
+
+func (st *RedisSessionStore) migrateNode(ctx context.Context, node redis.Cmdable) (int, error) {
+	migrated := 0
+	iter := node.ScanType(ctx, 0, sessionPrefix+"*", 100, "string").Iterator()
+	for iter.Next(ctx) {
+		converted, err := migrateSession.Run(ctx, st.client, []string{iter.Val()}, sessionField).Int()
+		if err != nil {
+			return migrated, err
+		}
+		migrated += converted
+	}
+	return migrated, iter.Err()
+}
@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemorySessionStore keeps sessions in process memory. It is meant for unit
+// tests and single-process development; sessions are lost on restart.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+	// index maps user IDs to their tokens and the tokens' creation times
+	index map[string]map[string]time.Time
+}
+
+type memorySession struct {
+	data      []byte
+	fields    map[string][]byte
+	expiresAt time.Time
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]memorySession),
+		index:    make(map[string]map[string]time.Time),
+	}
+}
+
+// lookup returns the stored session if it has not expired yet. The caller
+// must hold st.mu.
+func (st *MemorySessionStore) lookup(token string) (memorySession, bool) {
+	stored, ok := st.sessions[token]
+	if !ok {
+		return stored, false
+	}
+	if !time.Now().Before(stored.expiresAt) {
+		delete(st.sessions, token)
+		return stored, false
+	}
+	return stored, true
+}
+
+func (st *MemorySessionStore) Save(ctx context.Context, token string, session *Session) error {
+	// Stored as JSON so callers cannot modify the stored copy
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stored, _ := st.lookup(token)
+	st.sessions[token] = memorySession{data: sessionJSON, fields: stored.fields, expiresAt: session.ExpiresAt}
+	if st.index[session.UserID] == nil {
+		st.index[session.UserID] = make(map[string]time.Time)
+	}
+	st.index[session.UserID][token] = session.CreatedAt
+	return nil
+}
+
+func (st *MemorySessionStore) Get(ctx context.Context, token string) (*Session, error) {
+	st.mu.Lock()
+	stored, ok := st.lookup(token)
+	st.mu.Unlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	var session Session
+	if err := json.Unmarshal(stored.data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (st *MemorySessionStore) Update(ctx context.Context, token string, session *Session) error {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stored, ok := st.lookup(token)
+	if !ok {
+		// Like SET with KEEPTTL on a missing key, but without an expiry
+		// there is nothing sensible to keep
+		return nil
+	}
+	stored.data = sessionJSON
+	st.sessions[token] = stored
+	return nil
+}
+
+func (st *MemorySessionStore) Touch(ctx context.Context, token string, lastSeenAt, expiresAt time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stored, ok := st.lookup(token)
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	var session Session
+	if err := json.Unmarshal(stored.data, &session); err != nil {
+		return err
+	}
+	session.LastSeenAt = lastSeenAt
+	session.ExpiresAt = expiresAt
+	sessionJSON, err := json.Marshal(&session)
+	if err != nil {
+		return err
+	}
+	stored.data = sessionJSON
+	stored.expiresAt = expiresAt
+	st.sessions[token] = stored
+	return nil
+}
+
+func (st *MemorySessionStore) Data(ctx context.Context, token string) (map[string][]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stored, ok := st.lookup(token)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	data := make(map[string][]byte, len(stored.fields))
+	for name, value := range stored.fields {
+		data[name] = append([]byte(nil), value...)
+	}
+	return data, nil
+}
+
+func (st *MemorySessionStore) GetField(ctx context.Context, token, name string) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stored, ok := st.lookup(token)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	value, ok := stored.fields[name]
+	if !ok {
+		return nil, ErrSessionFieldNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (st *MemorySessionStore) SetFields(ctx context.Context, token string, fields map[string][]byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stored, ok := st.lookup(token)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if stored.fields == nil {
+		stored.fields = make(map[string][]byte, len(fields))
+		st.sessions[token] = stored
+	}
+	for name, value := range fields {
+		stored.fields[name] = append([]byte(nil), value...)
+	}
+	return nil
+}
+
+func (st *MemorySessionStore) DeleteFields(ctx context.Context, token string, names ...string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if stored, ok := st.lookup(token); ok {
+		for _, name := range names {
+			delete(stored.fields, name)
+		}
+	}
+	return nil
+}
+
+func (st *MemorySessionStore) Delete(ctx context.Context, token, userID string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, token)
+	delete(st.index[userID], token)
+	if len(st.index[userID]) == 0 {
+		delete(st.index, userID)
+	}
+	return nil
+}
+
+func (st *MemorySessionStore) UserTokens(ctx context.Context, userID string) ([]string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.liveTokens(userID), nil
+}
+
+// liveTokens prunes the user's index and returns what is left, oldest
+// first. The caller must hold st.mu.
+func (st *MemorySessionStore) liveTokens(userID string) []string {
+	tokens := make([]string, 0, len(st.index[userID]))
+	for token := range st.index[userID] {
+		if _, ok := st.lookup(token); !ok {
+			delete(st.index[userID], token)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return st.index[userID][tokens[i]].Before(st.index[userID][tokens[j]])
+	})
+	return tokens
+}
+
+func (st *MemorySessionStore) EnforceLimit(ctx context.Context, userID, token string, limit SessionLimit) ([]string, error) {
+	if limit.Max <= 0 {
+		return nil, nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tokens := st.liveTokens(userID)
+	if len(tokens) <= limit.Max {
+		return nil, nil
+	}
+	if !limit.EvictOldest {
+		delete(st.index[userID], token)
+		return nil, ErrSessionLimitReached
+	}
+	var evicted []string
+	for _, candidate := range tokens {
+		if len(evicted) == len(tokens)-limit.Max {
+			break
+		}
+		if candidate != token {
+			evicted = append(evicted, candidate)
+			delete(st.index[userID], candidate)
+		}
+	}
+	return evicted, nil
+}
+
+func (st *MemorySessionStore) Scan(ctx context.Context, fn func(token string, session *Session) bool) error {
+	// fn runs without the lock held, so it may call back into the store
+	st.mu.Lock()
+	tokens := make([]string, 0, len(st.sessions))
+	for token := range st.sessions {
+		tokens = append(tokens, token)
+	}
+	st.mu.Unlock()
+
+	for _, token := range tokens {
+		session, err := st.Get(ctx, token)
+		if errors.Is(err, ErrSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(token, session) {
+			return nil
+		}
+	}
+	return nil
+}
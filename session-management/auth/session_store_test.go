@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// A shorter-lived session saved later must not cut the user's index short
+// under the longer-lived sessions already in it.
+func TestSaveNeverShortensIndexTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := NewRedisSessionStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+	ctx := context.Background()
+
+	now := time.Now()
+	for _, session := range []*Session{
+		{UserID: "u1", CreatedAt: now, ExpiresAt: now.Add(30 * time.Minute), AbsoluteExpiresAt: now.Add(time.Hour)},
+		{UserID: "u1", CreatedAt: now, ExpiresAt: now.Add(15 * time.Minute), AbsoluteExpiresAt: now.Add(15 * time.Minute)},
+	} {
+		token, err := (&Server{}).generateToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(ctx, token, session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ttl := mr.TTL(userSessionsKey("u1")); ttl < 59*time.Minute {
+		t.Errorf("index TTL is %s, want about an hour", ttl)
+	}
+}
+
+// The server runs against an injected Redis client with sessions kept in a
+// MemorySessionStore.
+func TestServerWithMemorySessionStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	sessions := NewMemorySessionStore()
+	config := LoadConfig()
+	config.Redis = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	config.SessionStore = sessions
+	config.MailDir = t.TempDir()
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := `{"email": "alice@example.com", "password": "correct horse"}`
+	rec := httptest.NewRecorder()
+	NewRegisterHandler(server).HandleRegister(rec, httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(credentials)))
+	if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+		t.Fatalf("register answered %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	NewLoginHandler(server).HandleLogin(rec, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(credentials)))
+	var loginResp struct {
+		SessionToken string `json:"session_token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&loginResp); err != nil || loginResp.SessionToken == "" {
+		t.Fatalf("login answered %d without a session token", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/check-auth", nil)
+	req.Header.Set("Authorization", "Bearer "+loginResp.SessionToken)
+	rec = httptest.NewRecorder()
+	NewCheckAuthHandler(server).HandleCheckAuth(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("check-auth answered %d: %s", rec.Code, rec.Body)
+	}
+
+	if _, err := sessions.Get(context.Background(), loginResp.SessionToken); err != nil {
+		t.Errorf("session not in the memory store: %v", err)
+	}
+	if keys := mr.Keys(); strings.Contains(strings.Join(keys, " "), sessionPrefix) {
+		t.Errorf("sessions leaked into Redis: %v", keys)
+	}
+}
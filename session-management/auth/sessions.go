@@ -0,0 +1,433 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionPrefix      = "session:"
+	userSessionsSuffix = ":sessions"
+
+	deviceLabelHeader = "X-Device-Label"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionInfo is the view of a session returned to its owner. It never
+// exposes the session token itself, only a stable identifier derived from it.
+type SessionInfo struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+	// ImpersonatorID marks sessions an admin started on the user's behalf
+	ImpersonatorID string `json:"impersonator_id,omitempty"`
+}
+
+func newSessionInfo(token string, session *Session) SessionInfo {
+	return SessionInfo{
+		ID:          sessionID(token),
+		DeviceLabel: session.DeviceLabel,
+		UserAgent:   session.UserAgent,
+		IP:          session.IP,
+		CreatedAt:   session.CreatedAt,
+		LastSeenAt:  session.LastSeenAt,
+		ExpiresAt:   session.ExpiresAt,
+
+		ImpersonatorID: session.ImpersonatorID,
+	}
+}
+
+func userSessionsKey(userID string) string {
+	return userPrefix + userID + userSessionsSuffix
+}
+
+// sessionID derives the public identifier of a session from its token.
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func bearerToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(authHeader, "Bearer ")
+}
+
+// newSession prepares a session for the user, recording which device the
+// request came from. Clients may name the device with the X-Device-Label
+// header; otherwise a label is derived from the user agent.
+func (s *Server) newSession(r *http.Request, user *User) *Session {
+	userAgent := r.UserAgent()
+	label := r.Header.Get(deviceLabelHeader)
+	if label == "" {
+		label = deviceLabel(userAgent)
+	}
+
+	return &Session{
+		UserID:      user.ID,
+		Email:       user.Email,
+		UserAgent:   userAgent,
+		IP:          s.clientIP(r),
+		DeviceLabel: label,
+	}
+}
+
+// deviceLabel turns a user agent into a short description such as
+// "Firefox on Windows".
+func deviceLabel(userAgent string) string {
+	browser := "Unknown browser"
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	for _, candidate := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			return browser + " on " + candidate.name
+		}
+	}
+	return browser
+}
+
+// createSession stamps the session's timestamps, stores it and returns its
+// token. If that takes the user past MaxSessionsPerUser, the session is
+// either dropped again with ErrSessionLimitReached or the user's oldest
+// sessions are revoked, depending on SessionLimitPolicy. Impersonation
+// sessions live for ImpersonationTTL and are exempt from the limit, so they
+// never push the user out.
+func (s *Server) createSession(ctx context.Context, session *Session) (string, error) {
+	token, err := s.generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	lifetime := s.config.MaxLifetime
+	if session.ImpersonatorID != "" {
+		lifetime = s.config.ImpersonationTTL
+	}
+	session.AbsoluteExpiresAt = now.Add(lifetime)
+	session.ExpiresAt = s.idleExpiry(session, now)
+
+	if err := s.sessions.Save(ctx, token, session); err != nil {
+		return "", err
+	}
+	if session.ImpersonatorID != "" {
+		return token, nil
+	}
+
+	limit := SessionLimit{
+		Max:         s.config.MaxSessionsPerUser,
+		EvictOldest: s.config.SessionLimitPolicy == SessionLimitEvictOldest,
+	}
+	evicted, err := s.sessions.EnforceLimit(ctx, session.UserID, token, limit)
+	if err != nil {
+		s.sessions.Delete(ctx, token, session.UserID)
+		return "", err
+	}
+	for _, evictedToken := range evicted {
+		if err := s.revokeSession(ctx, evictedToken); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return "", err
+		}
+		s.audit(ctx, nil, AuditEvent{
+			Type:    AuditSessionRevoked,
+			UserID:  session.UserID,
+			Actor:   "session limit",
+			Outcome: AuditSuccess,
+			Detail:  sessionID(evictedToken),
+		})
+	}
+	return token, nil
+}
+
+// idleExpiry is when the session expires if it is not used again after now.
+func (s *Server) idleExpiry(session *Session, now time.Time) time.Time {
+	expiresAt := now.Add(s.config.IdleTimeout)
+	if expiresAt.After(session.AbsoluteExpiresAt) {
+		return session.AbsoluteExpiresAt
+	}
+	return expiresAt
+}
+
+// touchSession records that the session was just used and slides its
+// expiry forward by the idle timeout. Only the activity is written, so a
+// session revoked meanwhile stays revoked and concurrent changes to it are
+// kept. A session past its absolute lifetime is deleted instead and
+// reported as not found.
+func (s *Server) touchSession(ctx context.Context, token string, session *Session) error {
+	now := time.Now()
+	if !now.Before(session.AbsoluteExpiresAt) {
+		if err := s.sessions.Delete(ctx, token, session.UserID); err != nil {
+			return err
+		}
+		return ErrSessionNotFound
+	}
+
+	session.LastSeenAt = now
+	session.ExpiresAt = s.idleExpiry(session, now)
+	return s.sessions.Touch(ctx, token, session.LastSeenAt, session.ExpiresAt)
+}
+
+// lookupSession returns the session for a session token or, in JWT mode, an
+// access token JWT.
+func (s *Server) lookupSession(ctx context.Context, token string) (*Session, error) {
+	if isJWT(token) {
+		return s.verifySessionJWT(ctx, token)
+	}
+	return s.sessions.Get(ctx, token)
+}
+
+// endSession deletes a session, or denylists a JWT until it expires.
+func (s *Server) endSession(ctx context.Context, token, userID string) error {
+	if isJWT(token) {
+		return s.denySessionJWT(ctx, token)
+	}
+	return s.sessions.Delete(ctx, token, userID)
+}
+
+// revokeSession ends a session on behalf of its user. Unlike
+// SessionStore.Delete it also revokes the refresh tokens the session was
+// issued with, so the session cannot be brought back through /api/refresh.
+func (s *Server) revokeSession(ctx context.Context, token string) error {
+	session, err := s.lookupSession(ctx, token)
+	if err != nil {
+		return err
+	}
+	if session.RefreshFamily != "" {
+		if err := s.revokeRefreshFamily(ctx, session.RefreshFamily); err != nil {
+			return err
+		}
+	}
+	return s.endSession(ctx, token, session.UserID)
+}
+
+// revokeUserSessions revokes every session of the user except keepToken,
+// which may be empty, together with their refresh tokens, and returns how
+// many sessions were revoked.
+func (s *Server) revokeUserSessions(ctx context.Context, userID, keepToken string) (int, error) {
+	if s.config.TokenMode == TokenModeJWT {
+		return s.revokeRefreshFamilies(ctx, userID, keepToken)
+	}
+
+	tokens, err := s.sessions.UserTokens(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, token := range tokens {
+		if token == keepToken {
+			continue
+		}
+		if err := s.revokeSession(ctx, token); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return revoked, err
+		}
+		revoked++
+	}
+
+	// A family whose session has already expired would still hand out a
+	// new one through /api/refresh
+	if _, err := s.revokeRefreshFamilies(ctx, userID, keepToken); err != nil {
+		return revoked, err
+	}
+	return revoked, nil
+}
+
+// authenticatedSession loads the session named by the request's bearer token
+// or session cookie and marks it as seen. API keys are accepted in place of a
+// session token. Sessions waiting for a step-up are refused with
+// ErrStepUpRequired.
+func (s *Server) authenticatedSession(r *http.Request) (string, *Session, error) {
+	token, _ := tokenFromRequest(r)
+	if isAPIKey(token) {
+		session, err := s.apiKeySession(r.Context(), token)
+		if err != nil {
+			return "", nil, err
+		}
+		return token, session, nil
+	}
+	if isJWT(token) {
+		session, err := s.verifySessionJWT(r.Context(), token)
+		if err != nil {
+			return "", nil, err
+		}
+		return token, session, nil
+	}
+
+	session, err := s.sessions.Get(r.Context(), token)
+	if err != nil {
+		return "", nil, err
+	}
+	if session.StepUpRequired {
+		return "", nil, ErrStepUpRequired
+	}
+	if err := s.touchSession(r.Context(), token, session); err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := userSessionFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentToken := sessionTokenFromContext(r.Context())
+
+	tokens, err := s.sessions.UserTokens(r.Context(), current.UserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	sessions := make([]SessionInfo, 0, len(tokens))
+	for _, token := range tokens {
+		session, err := s.sessions.Get(r.Context(), token)
+		if err != nil {
+			continue
+		}
+		info := newSessionInfo(token, session)
+		info.Current = token == currentToken
+		sessions = append(sessions, info)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	current, ok := userSessionFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+
+	var revokeReq struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&revokeReq); err != nil || revokeReq.ID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.sessions.UserTokens(r.Context(), current.UserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, token := range tokens {
+		if sessionID(token) != revokeReq.ID {
+			continue
+		}
+		if err := s.revokeSession(r.Context(), token); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r.Context(), r, AuditEvent{
+			Type:    AuditSessionRevoked,
+			UserID:  current.UserID,
+			Actor:   sessionActor(current),
+			Outcome: AuditSuccess,
+			Detail:  revokeReq.ID,
+		})
+		writeJSON(w, http.StatusOK, map[string]string{
+			"message": "Session revoked",
+		})
+		return
+	}
+
+	http.Error(w, "Session not found", http.StatusNotFound)
+}
+
+func (s *Server) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := userSessionFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	currentToken := sessionTokenFromContext(r.Context())
+
+	revoked, err := s.revokeUserSessions(r.Context(), current.UserID, currentToken)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditSessionRevoked,
+		UserID:  current.UserID,
+		Actor:   current.UserID,
+		Outcome: AuditSuccess,
+		Detail:  fmt.Sprintf("%d other sessions", revoked),
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Other sessions revoked",
+		"revoked": revoked,
+	})
+}
+
+// SessionsHandler serves the caller's own sessions. Its handlers expect to be
+// mounted behind RequireSession.
+type SessionsHandler struct {
+	server *Server
+}
+
+func NewSessionsHandler(server *Server) *SessionsHandler {
+	return &SessionsHandler{server: server}
+}
+
+func (h *SessionsHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	h.server.handleListSessions(w, r)
+}
+
+func (h *SessionsHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	h.server.handleRevokeSession(w, r)
+}
+
+func (h *SessionsHandler) HandleRevokeOthers(w http.ResponseWriter, r *http.Request) {
+	h.server.handleRevokeOtherSessions(w, r)
+}
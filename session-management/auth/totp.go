@@ -0,0 +1,437 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	pendingTwoFactorPrefix = "pending_2fa:"
+	totpUsedPrefix         = "totp_used:"
+	recoveryCodesSuffix    = ":recovery_codes"
+
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is how many periods before and after the current one are
+	// accepted, to tolerate clock drift on the user's device.
+	totpSkew = 1
+
+	recoveryCodeCount        = 10
+	maxTwoFactorAttempts     = 5
+	totpSecretSize           = 20
+	recoveryCodeSize         = 5
+	totpUsedRetentionPeriods = 2*totpSkew + 1
+)
+
+var ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code for the given time step: HOTP (RFC
+// 4226) with HMAC-SHA1 over the big-endian step counter.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step the code is valid for, within the allowed
+// skew around now.
+func matchTOTP(encodedSecret, code string, now time.Time) (int64, bool) {
+	secret, err := base32NoPadding.DecodeString(strings.ToUpper(encodedSecret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) provisioningURI(email, secret string) string {
+	label := url.PathEscape(s.config.TOTPIssuer + ":" + email)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", s.config.TOTPIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func recoveryCodesKey(userID string) string {
+	return userPrefix + userID + recoveryCodesSuffix
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyTOTP checks a code against the user's secret and burns the matched
+// time step, so the same code cannot be replayed while it is still valid.
+func (s *Server) verifyTOTP(ctx context.Context, userID, secret, code string) error {
+	if secret == "" {
+		return ErrInvalidTwoFactorCode
+	}
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+
+	usedKey := fmt.Sprintf("%s%s:%d", totpUsedPrefix, userID, step)
+	first, err := s.redis.SetNX(ctx, usedKey, 1, totpUsedRetentionPeriods*totpPeriod).Result()
+	if err != nil {
+		return err
+	}
+	if !first {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// useRecoveryCode consumes one of the user's recovery codes. SREM removes the
+// code atomically, so each one works exactly once.
+func (s *Server) useRecoveryCode(ctx context.Context, userID, code string) error {
+	removed, err := s.redis.SRem(ctx, recoveryCodesKey(userID), hashRecoveryCode(code)).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// generateRecoveryCodes replaces the user's recovery codes with a fresh set
+// and returns them. Only their hashes are stored.
+func (s *Server) generateRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]interface{}, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeSize)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.Del(ctx, recoveryCodesKey(userID))
+	pipe.SAdd(ctx, recoveryCodesKey(userID), hashes...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// startTwoFactorLogin parks a password-verified login until the second
+// factor is supplied and returns the token that identifies it.
+func (s *Server) startTwoFactorLogin(ctx context.Context, user *User) (string, error) {
+	pendingToken, err := s.generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	pendingKey := pendingTwoFactorPrefix + pendingToken
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, pendingKey, "user_id", user.ID, "attempts", 0)
+	pipe.Expire(ctx, pendingKey, s.config.PendingTwoFactorTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return pendingToken, nil
+}
+
+func (s *Server) handleEnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	session, ok := userSessionFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+
+	secretBytes := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secretBytes); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	secret := base32NoPadding.EncodeToString(secretBytes)
+
+	// The secret only takes effect once a code generated from it is confirmed
+	err := s.redis.HSet(r.Context(), userPrefix+session.UserID, "totp_pending_secret", secret).Err()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"secret":           secret,
+		"provisioning_uri": s.provisioningURI(session.Email, secret),
+		"message":          "Scan the provisioning URI and confirm with a code",
+	})
+}
+
+func (s *Server) handleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	session, ok := userSessionFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+
+	var confirmReq struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&confirmReq); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userKey := userPrefix + session.UserID
+	secret, err := s.redis.HGet(r.Context(), userKey, "totp_pending_secret").Result()
+	if err != nil || secret == "" {
+		http.Error(w, "No enrollment in progress", http.StatusBadRequest)
+		return
+	}
+
+	err = s.verifyTOTP(r.Context(), session.UserID, secret, confirmReq.Code)
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(r.Context(), userKey, "totp_secret", secret)
+	pipe.HDel(r.Context(), userKey, "totp_pending_secret")
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := s.generateRecoveryCodes(r.Context(), session.UserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"recovery_codes": codes,
+		"message":        "Two-factor authentication enabled",
+	})
+}
+
+func (s *Server) handleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	session, ok := userSessionFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+
+	var disableReq struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&disableReq); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.getUser(r.Context(), session.UserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Two-factor authentication not enabled", http.StatusBadRequest)
+		return
+	}
+
+	err = s.verifyTOTP(r.Context(), user.ID, user.TOTPSecret, disableReq.Code)
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.HDel(r.Context(), userPrefix+user.ID, "totp_secret", "totp_pending_secret")
+	pipe.Del(r.Context(), recoveryCodesKey(user.ID))
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// handleVerifyTwoFactor completes a login parked by startTwoFactorLogin,
+// using either a TOTP code or a recovery code.
+func (s *Server) handleVerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var verifyReq struct {
+		PendingToken string `json:"pending_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&verifyReq); err != nil || verifyReq.PendingToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	pendingKey := pendingTwoFactorPrefix + verifyReq.PendingToken
+	userID, err := s.redis.HGet(r.Context(), pendingKey, "user_id").Result()
+	if err != nil || userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Each pending login only gets a few guesses
+	attempts, err := s.redis.HIncrBy(r.Context(), pendingKey, "attempts", 1).Result()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if attempts > maxTwoFactorAttempts {
+		s.redis.Del(r.Context(), pendingKey)
+		http.Error(w, "Too many attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	user, err := s.getUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Failed codes count towards the login lockout of the email and IP, so
+	// logging in again for a fresh pending token does not buy more guesses
+	ip := s.clientIP(r)
+	wait, err := s.loginRetryAfter(r.Context(), user.Email, ip)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	if verifyReq.RecoveryCode != "" {
+		err = s.useRecoveryCode(r.Context(), user.ID, verifyReq.RecoveryCode)
+	} else {
+		err = s.verifyTOTP(r.Context(), user.ID, user.TOTPSecret, verifyReq.Code)
+	}
+	method := "totp"
+	if verifyReq.RecoveryCode != "" {
+		method = "recovery code"
+	}
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		s.audit(r.Context(), r, AuditEvent{
+			Type:    AuditLogin,
+			UserID:  user.ID,
+			Actor:   user.ID,
+			Outcome: AuditFailure,
+			Detail:  "invalid " + method,
+		})
+		if err := s.recordLoginFailure(r.Context(), user.Email, ip); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Only one request may turn the pending login into a session
+	deleted, err := s.redis.Del(r.Context(), pendingKey).Result()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if deleted == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.clearLoginFailures(r.Context(), user.Email)
+
+	s.audit(r.Context(), r, AuditEvent{
+		Type:    AuditLogin,
+		UserID:  user.ID,
+		Actor:   user.ID,
+		Outcome: AuditSuccess,
+		Detail:  method,
+	})
+	s.completeLogin(w, r, user, "")
+}
+
+// TwoFactorHandler serves TOTP enrollment and verification. Enroll, Confirm
+// and Disable expect to be mounted behind RequireSession; Verify is called
+// with the pending token returned by a login instead.
+type TwoFactorHandler struct {
+	server *Server
+}
+
+func NewTwoFactorHandler(server *Server) *TwoFactorHandler {
+	return &TwoFactorHandler{server: server}
+}
+
+func (h *TwoFactorHandler) HandleEnroll(w http.ResponseWriter, r *http.Request) {
+	h.server.handleEnrollTwoFactor(w, r)
+}
+
+func (h *TwoFactorHandler) HandleConfirm(w http.ResponseWriter, r *http.Request) {
+	h.server.handleConfirmTwoFactor(w, r)
+}
+
+func (h *TwoFactorHandler) HandleDisable(w http.ResponseWriter, r *http.Request) {
+	h.server.handleDisableTwoFactor(w, r)
+}
+
+func (h *TwoFactorHandler) HandleVerify(w http.ResponseWriter, r *http.Request) {
+	h.server.handleVerifyTwoFactor(w, r)
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors.
+var rfc6238Secret = []byte("12345678901234567890")
+
+// The RFC 6238 appendix B vectors are 8 digits; ours are their last 6.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, tt.unix/30); got != tt.want {
+			t.Errorf("code at %d is %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := base32NoPadding.EncodeToString(rfc6238Secret)
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / 30
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"current step", totpCode(rfc6238Secret, current), true},
+		{"previous step", totpCode(rfc6238Secret, current-1), true},
+		{"next step", totpCode(rfc6238Secret, current+1), true},
+		{"two steps old", totpCode(rfc6238Secret, current-2), false},
+		{"too short", totpCode(rfc6238Secret, current)[:5], false},
+		{"not a code", "abcdef", false},
+	}
+	for _, tt := range tests {
+		if _, ok := matchTOTP(secret, tt.code, now); ok != tt.ok {
+			t.Errorf("%s: matched %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+	if _, ok := matchTOTP(strings.ToLower(secret), totpCode(rfc6238Secret, current), now); !ok {
+		t.Error("lowercase secret did not match")
+	}
+}
+
+// A code is accepted once; replaying it within its window fails.
+func TestVerifyTOTPReplay(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	ctx := context.Background()
+	secret := base32NoPadding.EncodeToString(rfc6238Secret)
+	code := totpCode(rfc6238Secret, time.Now().Unix()/30)
+
+	if err := server.verifyTOTP(ctx, "1", secret, code); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := server.verifyTOTP(ctx, "1", secret, code); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("replay returned %v, want ErrInvalidTwoFactorCode", err)
+	}
+	if err := server.verifyTOTP(ctx, "2", secret, code); err != nil {
+		t.Errorf("another user's first use: %v", err)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	ctx := context.Background()
+	codes, err := server.generateRecoveryCodes(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"first use", codes[0], true},
+		{"second use", codes[0], false},
+		{"without dash, uppercase", strings.ToUpper(strings.ReplaceAll(codes[1], "-", "")), true},
+		{"unknown", "00000-00000", false},
+	}
+	for _, tt := range tests {
+		err := server.useRecoveryCode(ctx, "1", tt.code)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: returned %v", tt.name, err)
+		}
+	}
+
+	// A new set replaces the old one
+	if _, err := server.generateRecoveryCodes(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.useRecoveryCode(ctx, "1", codes[2]); err == nil {
+		t.Error("a replaced recovery code still works")
+	}
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	userPrefix       = "user:"
+	userEmailPrefix  = "user:email:"
+	userIDCounterKey = "user:next_id"
+
+	minPasswordLength = 8
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrEmailTaken   = errors.New("email already registered")
+)
+
+type User struct {
+	ID           string    `json:"id"`
+	Email        string    `json:"email"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	// TOTPSecret is set once the user has confirmed TOTP enrollment
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+}
+
+type RegisterRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// createUser stores a new user hash and claims the email index entry.
+// The email is claimed with SETNX first so two concurrent registrations
+// for the same address cannot both succeed.
+func (s *Server) createUser(ctx context.Context, email, password string) (*User, error) {
+	email = normalizeEmail(email)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := s.redis.Incr(ctx, userIDCounterKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		ID:           strconv.FormatInt(id, 10),
+		Email:        email,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now(),
+	}
+
+	claimed, err := s.redis.SetNX(ctx, userEmailPrefix+email, user.ID, 0).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, ErrEmailTaken
+	}
+
+	err = s.redis.HSet(ctx, userPrefix+user.ID,
+		"email", user.Email,
+		"password_hash", user.PasswordHash,
+		"created_at", user.CreatedAt.Format(time.RFC3339Nano),
+	).Err()
+	if err != nil {
+		s.redis.Del(ctx, userEmailPrefix+email)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *Server) getUser(ctx context.Context, id string) (*User, error) {
+	fields, err := s.redis.HGetAll(ctx, userPrefix+id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339Nano, fields["created_at"])
+	return &User{
+		ID:           id,
+		Email:        fields["email"],
+		PasswordHash: fields["password_hash"],
+		CreatedAt:    createdAt,
+		TOTPSecret:   fields["totp_secret"],
+		TOTPEnabled:  fields["totp_secret"] != "",
+	}, nil
+}
+
+func (s *Server) getUserByEmail(ctx context.Context, email string) (*User, error) {
+	id, err := s.redis.Get(ctx, userEmailPrefix+normalizeEmail(email)).Result()
+	if err == redis.Nil {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.getUser(ctx, id)
+}
+
+func (s *Server) updatePassword(ctx context.Context, userID, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.redis.HSet(ctx, userPrefix+userID, "password_hash", string(hash)).Err()
+}
+
+// authenticate returns the user for the given credentials, or
+// ErrUserNotFound when either the email or the password is wrong.
+func (s *Server) authenticate(ctx context.Context, email, password string) (*User, error) {
+	user, err := s.getUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !strings.Contains(req.Email, "@") {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.createUser(r.Context(), req.Email, req.Password)
+	if errors.Is(err, ErrEmailTaken) {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, user)
+}
+
+type RegisterHandler struct {
+	server *Server
+}
+
+func NewRegisterHandler(server *Server) *RegisterHandler {
+	return &RegisterHandler{server: server}
+}
+
+func (h *RegisterHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	h.server.handleRegister(w, r)
+}
@@ -7,23 +7,88 @@ import (
 )
 
 func main() {
-	// Initialize the Redis server connection
-	redisAddr := "127.0.0.1:6379" // Change this to your Redis server address if needed
-	server := auth.NewServer(redisAddr)
+	// Initialize the Redis server connection; see auth.LoadConfig for the
+	// environment variables that override the defaults
+	config := auth.LoadConfig()
+	server, err := auth.NewServer(config)
+	if err != nil {
+		log.Fatalf("Could not start server: %s\n", err)
+	}
 
 	// Set up your HTTP handlers
 
+	registerHandler := auth.NewRegisterHandler(server)
 	loginHandler := auth.NewLoginHandler(server)
+	refreshHandler := auth.NewRefreshHandler(server)
 	logoutHandler := auth.NewLogoutHandler(server)
 	checkAuthHandler := auth.NewCheckAuthHandler(server)
+	sessionsHandler := auth.NewSessionsHandler(server)
+	passwordResetHandler := auth.NewPasswordResetHandler(server)
+	twoFactorHandler := auth.NewTwoFactorHandler(server)
+	lockoutHandler := auth.NewLockoutHandler(server)
+	adminSessionsHandler := auth.NewAdminSessionsHandler(server)
+	rolesHandler := auth.NewRolesHandler(server)
+	oidcHandler := auth.NewOIDCHandler(server)
+	jwksHandler := auth.NewJWKSHandler(server)
+	magicLinkHandler := auth.NewMagicLinkHandler(server)
+	auditHandler := auth.NewAuditHandler(server)
+	apiKeysHandler := auth.NewAPIKeysHandler(server)
+	sessionDataHandler := auth.NewSessionDataHandler(server)
+	impersonationHandler := auth.NewImpersonationHandler(server)
+	stepUpHandler := auth.NewStepUpHandler(server)
 	protectedHandler := auth.NewProtectedHandler()
 
 	// Serve static files from the 'public' directory
 
+	http.HandleFunc("/api/register", registerHandler.HandleRegister)
 	http.HandleFunc("/api/login", loginHandler.HandleLogin)
+	http.HandleFunc("/api/refresh", refreshHandler.HandleRefresh)
 	http.HandleFunc("/api/logout", logoutHandler.HandleLogout)
 	http.HandleFunc("/api/check-auth", checkAuthHandler.HandleCheckAuth)
-	http.HandleFunc("/api/protected", protectedHandler.HandleGet)
+	http.HandleFunc("/api/step-up", stepUpHandler.HandleStepUp)
+	http.Handle("/api/sessions", server.RequireSessionFunc(sessionsHandler.HandleList))
+	http.Handle("/api/sessions/revoke", server.RequireSessionFunc(sessionsHandler.HandleRevoke))
+	http.Handle("/api/sessions/revoke-others", server.RequireSessionFunc(sessionsHandler.HandleRevokeOthers))
+	http.Handle("/api/session/data", server.RequireSessionFunc(sessionDataHandler.HandleGet))
+	http.Handle("/api/session/data/set", server.RequireSessionFunc(sessionDataHandler.HandleSet))
+	http.Handle("/api/session/data/delete", server.RequireSessionFunc(sessionDataHandler.HandleDelete))
+	http.HandleFunc("/.well-known/jwks.json", jwksHandler.HandleJWKS)
+	http.HandleFunc("/api/admin/jwt/rotate", jwksHandler.HandleRotate)
+	http.HandleFunc("/api/oidc/login", oidcHandler.HandleLogin)
+	http.HandleFunc("/api/oidc/callback", oidcHandler.HandleCallback)
+	http.HandleFunc("/api/magic-link", magicLinkHandler.HandleRequest)
+	http.HandleFunc("/api/magic-link/login", magicLinkHandler.HandleLogin)
+	http.HandleFunc("/api/password/forgot", passwordResetHandler.HandleForgot)
+	http.HandleFunc("/api/password/reset", passwordResetHandler.HandleReset)
+	http.HandleFunc("/api/2fa/verify", twoFactorHandler.HandleVerify)
+	http.Handle("/api/2fa/enroll", server.RequireSessionFunc(twoFactorHandler.HandleEnroll))
+	http.Handle("/api/2fa/confirm", server.RequireSessionFunc(twoFactorHandler.HandleConfirm))
+	http.Handle("/api/2fa/disable", server.RequireSessionFunc(twoFactorHandler.HandleDisable))
+	http.HandleFunc("/api/admin/lockouts/clear", lockoutHandler.HandleClear)
+	http.HandleFunc("/api/admin/lockouts/events", lockoutHandler.HandleEvents)
+	http.HandleFunc("/api/admin/sessions", adminSessionsHandler.HandleList)
+	http.HandleFunc("/api/admin/sessions/expire", adminSessionsHandler.HandleExpire)
+	http.HandleFunc("/api/admin/sessions/reencrypt", adminSessionsHandler.HandleReencrypt)
+	http.HandleFunc("/api/admin/sessions/migrate", adminSessionsHandler.HandleMigrate)
+	http.HandleFunc("/api/admin/impersonate", impersonationHandler.HandleImpersonate)
+	http.HandleFunc("/api/admin/api-keys", apiKeysHandler.HandleList)
+	http.HandleFunc("/api/admin/api-keys/issue", apiKeysHandler.HandleIssue)
+	http.HandleFunc("/api/admin/api-keys/revoke", apiKeysHandler.HandleRevoke)
+	http.HandleFunc("/api/admin/audit", auditHandler.HandleEvents)
+	http.HandleFunc("/api/admin/roles", rolesHandler.HandleList)
+	http.HandleFunc("/api/admin/roles/save", rolesHandler.HandleSave)
+	http.HandleFunc("/api/admin/users/roles", rolesHandler.HandleGetUserRoles)
+	http.HandleFunc("/api/admin/users/roles/set", rolesHandler.HandleSetUserRoles)
+	http.Handle("/api/protected", server.RequireSessionFunc(protectedHandler.HandleGet))
+
+	// Development identity provider for the OIDC login
+	if config.OIDCMockIdP {
+		idp, err := auth.NewMockIdP(config.OIDCIssuer, config.OIDCClientID)
+		if err != nil {
+			log.Fatalf("Could not start mock IdP: %s\n", err)
+		}
+		http.Handle("/mock-idp/", http.StripPrefix("/mock-idp", idp))
+	}
 
 	// Start the HTTP server
 	log.Println("Starting server on :9001")
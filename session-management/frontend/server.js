@@ -14,33 +14,55 @@ app.get('/', (req, res) => {
     res.sendFile(path.join(__dirname, 'public', 'index.html')); // Serve index.html on root
 });
 
-app.post('/api/login', async (req, res) => {
-    console.log("Login clicked", req.body);
-    const response = await axios.post('http://127.0.0.1:9001/api/login', req.body, {
-        headers: { 'Content-Type': 'application/json' }
-    });
-    res.json(response.data); // Update to use axios response
+// Pass the browser's identity through so sessions record the real device
+// (the Go server reads X-Forwarded-For from the TRUSTED_PROXIES, loopback by default)
+const clientHeaders = (req) => ({
+    'User-Agent': req.get('User-Agent') || '',
+    'X-Forwarded-For': req.ip,
 });
 
-app.post('/api/logout', async (req, res) => {
-
-    const response = await axios.post('http://127.0.0.1:9001/api/logout', req.body, {
-        headers: {
-            'Content-Type': 'application/json',
-            'Authorization': req.headers.authorization
+// Forward a request to the Go server as is. Cookies and the CSRF header go
+// up, Set-Cookie comes back down, so in cookie mode (COOKIE_MODE=true) the
+// session and refresh tokens never pass through this app's JavaScript.
+const proxy = (backendPath) => async (req, res) => {
+    const headers = { 'Content-Type': 'application/json', ...clientHeaders(req) };
+    for (const name of ['authorization', 'cookie', 'x-csrf-token']) {
+        if (req.headers[name]) {
+            headers[name] = req.headers[name];
         }
-    });
-    res.json(response.data); // Update to use axios response
-});
+    }
 
-app.post('/api/check-auth', async (req, res) => {
-    const response = await axios.post('http://localhost:9001/api/check-auth', req.body, {
-        headers: {
-            'Content-Type': 'application/json',
-            'Authorization': req.headers.authorization
+    try {
+        const response = await axios.post('http://127.0.0.1:9001' + backendPath, req.body, {
+            headers,
+            validateStatus: () => true,
+        });
+        if (response.headers['set-cookie']) {
+            res.set('Set-Cookie', response.headers['set-cookie']);
         }
-    });
-    res.json(response.data); // Update to use axios response
+        res.status(response.status).send(response.data);
+    } catch (error) {
+        console.error('Proxy error:', error.message);
+        res.status(502).send('Server error');
+    }
+};
+
+app.post('/api/register', proxy('/api/register'));
+app.post('/api/login', proxy('/api/login'));
+app.post('/api/refresh', proxy('/api/refresh'));
+app.post('/api/logout', proxy('/api/logout'));
+app.post('/api/check-auth', proxy('/api/check-auth'));
+app.post('/api/password/forgot', proxy('/api/password/forgot'));
+app.post('/api/password/reset', proxy('/api/password/reset'));
+app.post('/api/magic-link', proxy('/api/magic-link'));
+app.post('/api/magic-link/login', proxy('/api/magic-link/login'));
+
+// Targets of the links in password reset and login emails
+app.get('/reset-password', (req, res) => {
+    res.sendFile(path.join(__dirname, 'public', 'reset-password.html'));
+});
+app.get('/magic-login', (req, res) => {
+    res.sendFile(path.join(__dirname, 'public', 'magic-login.html'));
 });
 
 app.listen(PORT, () => {
@@ -0,0 +1,140 @@
+// account.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// The account pages are htmx fragments swapped into #page. Successful
+// changes queue a flash message and trigger the flash event, plus
+// profileUpdated or passwordChanged for anything else on the page that
+// cares. A password change also sends the new CSRF token in csrfToken.
+
+type accountPage struct {
+	User  *User
+	Error string
+}
+
+// requireLogin returns the logged-in user of a session, writing a 401
+// fragment if the session belongs to a visitor.
+func requireLogin(w http.ResponseWriter, session *Session) (*User, bool) {
+	if session == nil || session.Username == "" {
+		writeStatus(w, http.StatusUnauthorized, "Please log in first")
+		return nil, false
+	}
+	user, err := getUser(session.Username)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return nil, false
+	}
+	return user, true
+}
+
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	_, session, _ := loadSession(r)
+	user, ok := requireLogin(w, session)
+	if !ok {
+		return
+	}
+	render(w, http.StatusOK, "profile.html", accountPage{User: user})
+}
+
+func profileEditHandler(w http.ResponseWriter, r *http.Request) {
+	_, session, _ := loadSession(r)
+	user, ok := requireLogin(w, session)
+	if !ok {
+		return
+	}
+	render(w, http.StatusOK, "profile_edit.html", accountPage{User: user})
+}
+
+func profileUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, session, ok := checkCSRF(w, r)
+	if !ok {
+		return
+	}
+	user, ok := requireLogin(w, session)
+	if !ok {
+		return
+	}
+
+	user.DisplayName = r.FormValue("display_name")
+	user.Email = r.FormValue("email")
+	if message := validateProfile(user.DisplayName, user.Email); message != "" {
+		render(w, http.StatusUnprocessableEntity, "profile_edit.html", accountPage{User: user, Error: message})
+		return
+	}
+	if err := updateProfile(user.Username, user.DisplayName, user.Email); err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	addFlash(sessionID, "Profile updated")
+	w.Header().Set("HX-Trigger", "profileUpdated, flash")
+	render(w, http.StatusOK, "profile.html", accountPage{User: user})
+}
+
+func passwordFormHandler(w http.ResponseWriter, r *http.Request) {
+	_, session, _ := loadSession(r)
+	user, ok := requireLogin(w, session)
+	if !ok {
+		return
+	}
+	render(w, http.StatusOK, "password.html", accountPage{User: user})
+}
+
+func passwordChangeHandler(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := checkCSRF(w, r)
+	if !ok {
+		return
+	}
+	user, ok := requireLogin(w, session)
+	if !ok {
+		return
+	}
+
+	newPassword := r.FormValue("new_password")
+	page := accountPage{User: user}
+	switch {
+	case authenticate(user.Username, r.FormValue("current_password")) != nil:
+		page.Error = "Your current password is not right"
+	case len(newPassword) < minPasswordLength:
+		page.Error = fmt.Sprintf("Passwords need at least %d characters", minPasswordLength)
+	case newPassword != r.FormValue("confirm_password"):
+		page.Error = "The new passwords do not match"
+	}
+	if page.Error != "" {
+		render(w, http.StatusUnprocessableEntity, "password.html", page)
+		return
+	}
+
+	if err := setPassword(user.Username, newPassword); err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	// Every session of the user ends, so a stolen cookie stops working
+	// everywhere. The new session gets a new CSRF token too, which the page
+	// picks up from the csrfToken event.
+	if err := endUserSessions(user.Username); err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	newSession := &Session{Username: user.Username}
+	newID, err := startSession(w, newSession)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+
+	addFlash(newID, "Password changed")
+	trigger, _ := json.Marshal(map[string]interface{}{
+		"passwordChanged": nil,
+		"flash":           nil,
+		"csrfToken":       newSession.CSRFToken,
+	})
+	w.Header().Set("HX-Trigger", string(trigger))
+	render(w, http.StatusOK, "profile.html", page)
+}
@@ -3,27 +3,22 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
-	"time"
+	"os"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
 )
 
-type User struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
-
 var (
-	rdb    *redis.Client
-	ctx    = context.Background()
-	secret = []byte("your-secret-key")
+	rdb *redis.Client
+	ctx = context.Background()
+	// secret signs the session cookies; see init
+	secret []byte
 )
 
 func init() {
@@ -31,94 +26,184 @@ func init() {
 		Addr: "localhost:6379",
 		DB:   0,
 	})
+	// Without SESSION_SECRET a random key is used, so sessions do not
+	// survive a restart
+	if value := os.Getenv("SESSION_SECRET"); value != "" {
+		secret = []byte(value)
+	} else {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+		fmt.Println("SESSION_SECRET is not set; using a random key, sessions will end on restart")
+	}
 }
 
 func main() {
 	r := mux.NewRouter()
 	r.HandleFunc("/", homeHandler).Methods("GET")
+	r.HandleFunc("/signup", signupFormHandler).Methods("GET")
+	r.HandleFunc("/signup", signupHandler).Methods("POST")
 	r.HandleFunc("/login", loginHandler).Methods("POST")
 	r.HandleFunc("/logout", logoutHandler).Methods("POST")
 	r.HandleFunc("/check-auth", checkAuthHandler).Methods("GET")
+	r.HandleFunc("/flash", flashHandler).Methods("GET")
+	r.HandleFunc("/profile", profileHandler).Methods("GET")
+	r.HandleFunc("/profile/edit", profileEditHandler).Methods("GET")
+	r.HandleFunc("/profile", profileUpdateHandler).Methods("POST")
+	r.HandleFunc("/password", passwordFormHandler).Methods("GET")
+	r.HandleFunc("/password", passwordChangeHandler).Methods("POST")
 
 	fmt.Println("Server is running on port 9000")
 	http.ListenAndServe(":9000", r)
 }
 
+// render executes the HTML template file name with data.
+func render(w http.ResponseWriter, status int, name string, data interface{}) {
+	tmpl, err := template.ParseFiles(name)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	tmpl.Execute(w, data)
+}
+
+// writeStatus answers with the authStatus fragment htmx swaps into the page.
+func writeStatus(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(`<div id="authStatus">` + template.HTMLEscapeString(message) + `</div>`))
+}
+
+// homeHandler makes sure the visitor has a session, whose CSRF token the
+// page hands to htmx for every request.
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("index.html"))
-	tmpl.Execute(w, nil)
+	_, session, err := ensureSession(w, r)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	render(w, http.StatusOK, "index.html", session)
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
+func signupFormHandler(w http.ResponseWriter, r *http.Request) {
+	render(w, http.StatusOK, "signup.html", nil)
+}
+
+func signupHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, session, ok := checkCSRF(w, r)
+	if !ok {
+		return
+	}
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
-	// In a real app, validate against DB
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	storedHash := hashedPassword // Simulate stored password
-
-	if err := bcrypt.CompareHashAndPassword(storedHash, []byte(password)); err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	if !validUsername.MatchString(username) {
+		writeStatus(w, http.StatusBadRequest, "Usernames are 3 to 32 letters, digits, dots, dashes or underscores")
+		return
+	}
+	if len(password) < minPasswordLength {
+		writeStatus(w, http.StatusBadRequest, fmt.Sprintf("Passwords need at least %d characters", minPasswordLength))
 		return
 	}
 
-	// Create session
-	sessionID := uuid.New().String()
-	userData, _ := json.Marshal(User{Username: username})
+	err := createUser(username, password)
+	if errors.Is(err, errUsernameTaken) {
+		writeStatus(w, http.StatusConflict, "That username is taken")
+		return
+	}
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return
+	}
 
-	// Store in Redis with 24 hour expiry
-	rdb.Set(ctx, "session:"+sessionID, userData, 24*time.Hour)
+	// Signing up logs the user in right away
+	if !logIn(w, sessionID, session, username) {
+		return
+	}
+	w.Header().Set("HX-Trigger", "authSuccess, flash")
+	writeStatus(w, http.StatusOK, "Logged in as "+username)
+}
 
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, session, ok := checkCSRF(w, r)
+	if !ok {
+		return
+	}
+	username := r.FormValue("username")
+	password := r.FormValue("password")
 
-	// Set cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_id",
-		Value:    sessionID,
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   86400,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-	})
+	err := authenticate(username, password)
+	if errors.Is(err, errInvalidCredentials) {
+		writeStatus(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return
+	}
 
-	w.Header().Set("HX-Trigger", "authSuccess")
-	w.Write([]byte(`<div id="authStatus">Logged in as ` + username + `</div>`))
+	if !logIn(w, sessionID, session, username) {
+		return
+	}
+	w.Header().Set("HX-Trigger", "authSuccess, flash")
+	writeStatus(w, http.StatusOK, "Logged in as "+username)
+}
 
+// logIn replaces the visitor session with one for the user. The CSRF token
+// carries over, so the page keeps working without a reload.
+func logIn(w http.ResponseWriter, sessionID string, session *Session, username string) bool {
+	endSession(sessionID, session)
+	newID, err := startSession(w, &Session{Username: username, CSRFToken: session.CSRFToken})
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return false
+	}
+	addFlash(newID, "Welcome, "+username)
+	return true
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	fmt.Println("Cookie:", cookie)
-	if err == nil {
-		rdb.Del(ctx, "session:"+cookie.Value)
-	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_id",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-	})
+	sessionID, session, ok := checkCSRF(w, r)
+	if !ok {
+		return
+	}
+
+	// Back to a visitor session with the same CSRF token
+	endSession(sessionID, session)
+	if _, err := startSession(w, &Session{CSRFToken: session.CSRFToken}); err != nil {
+		writeStatus(w, http.StatusInternalServerError, "Server error")
+		return
+	}
 
 	w.Header().Set("HX-Trigger", "authLogout")
-	w.Write([]byte(`<div id="authStatus">Logged out</div>`))
+	writeStatus(w, http.StatusOK, "Logged out")
 }
 
 func checkAuthHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
+	username, ok := currentUser(r)
+	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	val, err := rdb.Get(ctx, "session:"+cookie.Value).Result()
+	writeStatus(w, http.StatusOK, "Logged in as "+username)
+}
+
+// flashHandler renders and clears the session's flash messages. The page
+// fetches them whenever a response triggers the flash event.
+func flashHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, _, ok := loadSession(r)
+	if !ok {
+		render(w, http.StatusOK, "flash.html", nil)
+		return
+	}
+	messages, err := popFlashes(sessionID)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-
-	var user User
-	json.Unmarshal([]byte(val), &user)
-	w.Write([]byte(`<div id="authStatus">Logged in as ` + user.Username + `</div>`))
+	render(w, http.StatusOK, "flash.html", messages)
 }
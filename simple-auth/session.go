@@ -0,0 +1,220 @@
+// session.go
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	sessionCookieName = "session_id"
+	sessionPrefix     = "session:"
+	flashSuffix       = ":flash"
+	sessionsSuffix    = ":sessions"
+	sessionTTL        = 24 * time.Hour
+
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+// Session is stored as JSON under session:<id>. Visitors get one before they
+// log in, so that the forms they submit can carry its CSRF token; Username
+// is set once they have logged in. One-shot flash messages for the next page
+// are queued in the list session:<id>:flash. The IDs of a user's sessions
+// are kept in the set user:<username>:sessions, so they can all be ended at
+// once.
+type Session struct {
+	Username  string `json:"username,omitempty"`
+	CSRFToken string `json:"csrf_token,omitempty"`
+}
+
+// The session_id cookie holds the session ID and its HMAC under secret,
+// "<id>.<signature>", so forged or tampered cookies are turned away without
+// a Redis lookup.
+
+func signSessionID(sessionID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sessionID))
+	return sessionID + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionIDFromRequest returns the session ID from the request's cookie if
+// its signature checks out.
+func sessionIDFromRequest(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+	sessionID, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(cookie.Value), []byte(signSessionID(sessionID))) {
+		return "", false
+	}
+	return sessionID, true
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// loadSession returns the request's session. Sessions from before CSRF
+// tokens existed are given one.
+func loadSession(r *http.Request) (string, *Session, bool) {
+	sessionID, ok := sessionIDFromRequest(r)
+	if !ok {
+		return "", nil, false
+	}
+
+	val, err := rdb.Get(ctx, sessionPrefix+sessionID).Result()
+	if err != nil {
+		return "", nil, false
+	}
+	var session Session
+	if err := json.Unmarshal([]byte(val), &session); err != nil {
+		return "", nil, false
+	}
+
+	if session.CSRFToken == "" {
+		if session.CSRFToken, err = newCSRFToken(); err != nil {
+			return "", nil, false
+		}
+		sessionData, _ := json.Marshal(session)
+		rdb.Set(ctx, sessionPrefix+sessionID, sessionData, redis.KeepTTL)
+	}
+	return sessionID, &session, true
+}
+
+// startSession stores a new session and sets its cookie. A session the
+// request already had should be passed to endSession; logging in or out
+// always starts a new one, so a session ID planted before login is useless.
+func startSession(w http.ResponseWriter, session *Session) (string, error) {
+	if session.CSRFToken == "" {
+		var err error
+		if session.CSRFToken, err = newCSRFToken(); err != nil {
+			return "", err
+		}
+	}
+
+	sessionID := uuid.New().String()
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, sessionPrefix+sessionID, sessionData, sessionTTL)
+	if session.Username != "" {
+		pipe.SAdd(ctx, userSessionsKey(session.Username), sessionID)
+		pipe.Expire(ctx, userSessionsKey(session.Username), sessionTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    signSessionID(sessionID),
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   int(sessionTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return sessionID, nil
+}
+
+func endSession(sessionID string, session *Session) {
+	rdb.Del(ctx, sessionPrefix+sessionID)
+	rdb.Del(ctx, sessionPrefix+sessionID+flashSuffix)
+	if session.Username != "" {
+		rdb.SRem(ctx, userSessionsKey(session.Username), sessionID)
+	}
+}
+
+func userSessionsKey(username string) string {
+	return userPrefix + username + sessionsSuffix
+}
+
+// endUserSessions ends every session of the user, wherever they are logged
+// in.
+func endUserSessions(username string) error {
+	sessionIDs, err := rdb.SMembers(ctx, userSessionsKey(username)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{userSessionsKey(username)}
+	for _, sessionID := range sessionIDs {
+		keys = append(keys, sessionPrefix+sessionID, sessionPrefix+sessionID+flashSuffix)
+	}
+	return rdb.Del(ctx, keys...).Err()
+}
+
+// ensureSession returns the request's session, starting a visitor session
+// if there is none.
+func ensureSession(w http.ResponseWriter, r *http.Request) (string, *Session, error) {
+	if sessionID, session, ok := loadSession(r); ok {
+		return sessionID, session, nil
+	}
+	session := &Session{}
+	sessionID, err := startSession(w, session)
+	return sessionID, session, err
+}
+
+// currentUser returns the username of the request's session.
+func currentUser(r *http.Request) (string, bool) {
+	_, session, ok := loadSession(r)
+	if !ok || session.Username == "" {
+		return "", false
+	}
+	return session.Username, true
+}
+
+// checkCSRF loads the session of a state-changing request and checks the
+// CSRF token it sent in the X-CSRF-Token header, where index.html makes htmx
+// put it, or in the csrf_token form field. It writes a 403 on failure.
+func checkCSRF(w http.ResponseWriter, r *http.Request) (string, *Session, bool) {
+	sessionID, session, ok := loadSession(r)
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.FormValue(csrfFormField)
+	}
+	if !ok || token == "" || !hmac.Equal([]byte(token), []byte(session.CSRFToken)) {
+		writeStatus(w, http.StatusForbidden, "Your session has expired, please reload the page")
+		return "", nil, false
+	}
+	return sessionID, session, true
+}
+
+// addFlash queues a message for the next time the page asks for flashes.
+func addFlash(sessionID, message string) error {
+	key := sessionPrefix + sessionID + flashSuffix
+	pipe := rdb.TxPipeline()
+	pipe.RPush(ctx, key, message)
+	pipe.Expire(ctx, key, sessionTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// popFlashes returns the queued messages and removes them, so each one is
+// shown once.
+func popFlashes(sessionID string) ([]string, error) {
+	key := sessionPrefix + sessionID + flashSuffix
+	pipe := rdb.TxPipeline()
+	messages := pipe.LRange(ctx, key, 0, -1)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return messages.Val(), nil
+}
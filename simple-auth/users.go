@@ -0,0 +1,124 @@
+// users.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users are stored as hashes under user:<username> with the bcrypt hash of
+// their password and their profile.
+const userPrefix = "user:"
+
+const (
+	minPasswordLength  = 8
+	maxDisplayNameSize = 64
+	maxEmailSize       = 254
+)
+
+type User struct {
+	Username    string
+	DisplayName string
+	Email       string
+	CreatedAt   time.Time
+}
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errUsernameTaken      = errors.New("username taken")
+	errUserNotFound       = errors.New("user not found")
+
+	validUsername = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+	// dummyHash is compared against when the user does not exist, so that
+	// unknown usernames take as long to reject as wrong passwords
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+)
+
+func createUser(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	// HSETNX claims the username, so two signups for it cannot both succeed
+	created, err := rdb.HSetNX(ctx, userPrefix+username, "password_hash", hash).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return errUsernameTaken
+	}
+	return rdb.HSet(ctx, userPrefix+username, "created_at", time.Now().Unix()).Err()
+}
+
+// authenticate returns errInvalidCredentials when either the username or
+// the password is wrong.
+func authenticate(username, password string) error {
+	hash, err := rdb.HGet(ctx, userPrefix+username, "password_hash").Result()
+	if err == redis.Nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return errInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+func getUser(username string) (*User, error) {
+	fields, err := rdb.HGetAll(ctx, userPrefix+username).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errUserNotFound
+	}
+
+	user := &User{
+		Username:    username,
+		DisplayName: fields["display_name"],
+		Email:       fields["email"],
+	}
+	if createdAt, err := strconv.ParseInt(fields["created_at"], 10, 64); err == nil {
+		user.CreatedAt = time.Unix(createdAt, 0)
+	}
+	return user, nil
+}
+
+// validateProfile returns a message for the first invalid field, or "".
+func validateProfile(displayName, email string) string {
+	if len(displayName) > maxDisplayNameSize {
+		return fmt.Sprintf("Display names can be at most %d characters", maxDisplayNameSize)
+	}
+	if email != "" && (len(email) > maxEmailSize || !strings.Contains(email, "@")) {
+		return "That email address does not look right"
+	}
+	return ""
+}
+
+func updateProfile(username, displayName, email string) error {
+	return rdb.HSet(ctx, userPrefix+username,
+		"display_name", displayName,
+		"email", email,
+	).Err()
+}
+
+func setPassword(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, userPrefix+username, "password_hash", hash).Err()
+}